@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+	"github.com/zaigie/palworld-server-tool/service"
+)
+
+// listBackupFilesByServer godoc
+//
+//	@Summary		List Backup Files By Server
+//	@Description	List the files inside a backup. Player saves are mapped to known players.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Param			backup_id	path		string	true	"Backup ID"
+//	@Success		200			{object}	[]tool.BackupEntry
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/files [get]
+func listBackupFilesByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	if _, exists := config.GetServer(serverId); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	db := database.GetDB()
+	backup, err := service.GetBackupByServer(db, serverId, backupId)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := tool.ListBackupEntriesByServer(db, backup)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// downloadBackupFileByServer godoc
+//
+//	@Summary		Download Backup File By Server
+//	@Description	Download a single file of a backup, e.g. Players/<uid>.sav
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		application/octet-stream
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Param			backup_id	path		string	true	"Backup ID"
+//	@Param			name		query		string	true	"File name as listed"
+//	@Success		200			{file}		"Savefile"
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Failure		500			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/file [get]
+func downloadBackupFileByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	name := c.Query("name")
+	if _, exists := config.GetServer(serverId); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	backup, err := service.GetBackupByServer(database.GetDB(), serverId, backupId)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(name)))
+	c.Header("Content-Type", "application/octet-stream")
+	if err := tool.WriteBackupEntryByServer(backup, name, c.Writer); err != nil {
+		if !c.Writer.Written() {
+			c.Header("Content-Disposition", "")
+			c.Header("Content-Type", "")
+			if errors.Is(err, os.ErrNotExist) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found in backup"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Errorf("Failed to send %s of backup %s of server %s: %v\n", name, backup.Path, serverId, err)
+	}
+}
+
+// restorePlayerByServer godoc
+//
+//	@Summary		Restore Player By Server
+//	@Description	Restore only the save file of one player from a backup. A safety backup of the current save is taken first.
+//	@Description	The player uid may be the save file guid or the uid reported by the players list.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string				true	"Server ID"
+//	@Param			backup_id	path		string				true	"Backup ID"
+//	@Param			player_uid	path		string				true	"Player UID"
+//	@Param			options		body		tool.RestoreOptions	false	"Restore options, files is ignored"
+//	@Success		200			{object}	tool.RestorePlan
+//	@Success		202			{object}	RestoreResponse
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Failure		409			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/players/{player_uid}/restore [post]
+func restorePlayerByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	playerUid := c.Param("player_uid")
+	server, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	var opts tool.RestoreOptions
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	db := database.GetDB()
+	backup, err := service.GetBackupByServer(db, serverId, backupId)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := tool.FindPlayerSavByServer(db, backup, playerUid)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Player save not found in backup"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts.Files = []string{name}
+
+	if opts.DryRun {
+		plan, tempDir, err := tool.PlanRestoreWithConfig(server, backup, opts.Files)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		os.RemoveAll(tempDir)
+		c.JSON(http.StatusOK, plan)
+		return
+	}
+
+	restoreId, err := tool.StartRestoreWithConfig(db, server, backup, opts)
+	if err != nil {
+		if err == tool.ErrRestoreRunning {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"restore_id": restoreId})
+}
+
+// diffBackupsByServer godoc
+//
+//	@Summary		Diff Backups By Server
+//	@Description	Decode two backups and report the players, pals, items and guilds changed between them.
+//	@Description	Use current for either backup to compare with the data of the last save sync.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Param			backup_id	path		string	true	"Older Backup ID or current"
+//	@Param			other_id	path		string	true	"Newer Backup ID or current"
+//	@Success		200			{object}	tool.SaveDiff
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/diff/{other_id} [get]
+func diffBackupsByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	server, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	db := database.GetDB()
+	for _, id := range []string{c.Param("backup_id"), c.Param("other_id")} {
+		if id == tool.CurrentSnapshot {
+			continue
+		}
+		if _, err := service.GetBackupByServer(db, serverId, id); err != nil {
+			if err == service.ErrNoRecord {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	diff, err := tool.DiffSnapshotsByServer(db, server, c.Param("backup_id"), c.Param("other_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
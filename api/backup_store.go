@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+)
+
+// checkBackupStore godoc
+//
+//	@Summary		Check Backup Store
+//	@Description	Verify every chunk referenced by a chunked backup is present and intact
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Success		200	{object}	chunkstore.CheckResult
+//	@Failure		400	{object}	ErrorResponse
+//	@Router			/api/backup-store/check [get]
+func checkBackupStore(c *gin.Context) {
+	result, err := tool.CheckBackupStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// gcBackupStore godoc
+//
+//	@Summary		Collect Backup Store Garbage
+//	@Description	Remove the chunks no longer referenced by any backup
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Success		200	{object}	chunkstore.GCResult
+//	@Failure		400	{object}	ErrorResponse
+//	@Router			/api/backup-store/gc [post]
+func gcBackupStore(c *gin.Context) {
+	result, err := tool.GCBackupStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/task"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+)
+
+// maxIngestSize limits the size of a pushed sav.zip
+const maxIngestSize = 1 << 30
+
+// ingestSaveByServer godoc
+//
+//	@Summary		Ingest Save By Server
+//	@Description	Receive a sav.zip pushed by pst-agent and decode it right away as a sav job.
+//	@Description	A push arriving while a save is decoding is decoded after it, replacing older waiting pushes.
+//	@Description	Authenticated with the save.ingest_token of the server instead of a login token.
+//	@Tags			Sync
+//	@Accept			application/zip
+//	@Produce		json
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Success		202			{object}	JobResponse
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		401			{object}	ErrorResponse
+//	@Failure		403			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/ingest [post]
+func ingestSaveByServer(c *gin.Context) {
+	server, exists := config.GetServer(c.Param("server_id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+	if server.Save.IngestToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "save.ingest_token not set for this server"})
+		return
+	}
+	if err := source.VerifyAgentRequest(c.Request, server.Save.IngestToken); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	zipFile := filepath.Join(os.TempDir(), "palworldsav-ingest-"+uuid.New().String()+".zip")
+	out, err := os.Create(zipFile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = io.Copy(out, http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestSize))
+	out.Close()
+	if err != nil {
+		os.Remove(zipFile)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	levelFilePath, err := tool.UnpackIngest(zipFile)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, queued := task.IngestSave(server, levelFilePath)
+	c.JSON(http.StatusAccepted, JobResponse{Success: true, JobId: job.Id, Coalesced: queued})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/task"
+)
+
+type JobResponse struct {
+	Success bool   `json:"success"`
+	JobId   string `json:"job_id"`
+	// Coalesced is set when the sync joined a job already running for the server
+	Coalesced bool `json:"coalesced"`
+}
+
+type JobsResponse struct {
+	Success bool     `json:"success"`
+	JobIds  []string `json:"job_ids"`
+}
+
+// listJobs godoc
+//
+//	@Summary		List Jobs
+//	@Description	List the recent sync and backup jobs, newest first
+//	@Tags			Sync
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	query		string	false	"Server ID"
+//	@Param			kind		query		string	false	"Kind"	enum(rest,sav,backup)
+//	@Param			limit		query		int		false	"Limit"
+//	@Success		200			{array}		task.Job
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		401			{object}	ErrorResponse
+//	@Router			/api/jobs [get]
+func listJobs(c *gin.Context) {
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, task.ListJobs(c.Query("server_id"), c.Query("kind"), limit))
+}
+
+// getJob godoc
+//
+//	@Summary		Get Job
+//	@Description	Get the state, duration and error of a sync or backup job
+//	@Tags			Sync
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			job_id	path		string	true	"Job ID"
+//	@Success		200		{object}	task.Job
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Router			/api/jobs/{job_id} [get]
+func getJob(c *gin.Context) {
+	job, ok := task.GetJob(c.Param("job_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
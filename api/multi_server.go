@@ -4,8 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/zaigie/palworld-server-tool/internal/config"
 	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/task"
 	"github.com/zaigie/palworld-server-tool/internal/tool"
 	"github.com/zaigie/palworld-server-tool/service"
@@ -278,6 +277,7 @@ func publishBroadcastByServer(c *gin.Context) {
 //	@Failure		400			{object}	ErrorResponse
 //	@Failure		401			{object}	ErrorResponse
 //	@Failure		404			{object}	ErrorResponse
+//	@Failure		409			{object}	ErrorResponse
 //	@Router			/api/servers/{server_id}/shutdown [post]
 func shutdownServerByServer(c *gin.Context) {
 	serverId := c.Param("server_id")
@@ -299,6 +299,22 @@ func shutdownServerByServer(c *gin.Context) {
 	if req.Seconds == 0 {
 		req.Seconds = 60
 	}
+	if req.Backup {
+		job, started := task.RunJob(server.Id, task.JobKindBackup, func() error {
+			_, err := tool.NewBackupWithConfig(database.GetDB(), server, tool.BackupOptions{
+				Trigger: database.BackupTriggerPreShutdown,
+			})
+			return err
+		})
+		if !started {
+			c.JSON(http.StatusConflict, gin.H{"error": "a backup is already running for this server, job " + job.Id})
+			return
+		}
+		if job.State == task.JobStateFailed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pre-shutdown backup failed: " + job.Error})
+			return
+		}
+	}
 	if err := tool.ShutdownWithConfig(server, req.Seconds, req.Message); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -502,14 +518,15 @@ func putGuildsByServer(c *gin.Context) {
 // syncDataByServer godoc
 //
 //	@Summary		Sync Data By Server
-//	@Description	Sync Data By Server
+//	@Description	Start a sync job for the server, or join the one already running. Poll it with /api/jobs/{job_id}
 //	@Tags			Sync
 //	@Accept			json
 //	@Produce		json
 //	@Security		ApiKeyAuth
 //	@Param			server_id	path		string	true	"Server ID"
 //	@Param			from		query		From	true	"from"	enum(rest,sav)
-//	@Success		200			{object}	SuccessResponse
+//	@Param			force		query		bool	false	"Decode the save even when unchanged"
+//	@Success		200			{object}	JobResponse
 //	@Failure		400			{object}	ErrorResponse
 //	@Failure		401			{object}	ErrorResponse
 //	@Failure		404			{object}	ErrorResponse
@@ -524,12 +541,12 @@ func syncDataByServer(c *gin.Context) {
 
 	from := c.Query("from")
 	if from == "rest" {
-		go task.PlayerSyncByServer(database.GetDB(), serverId)
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		job, started := task.PlayerSyncByServer(database.GetDB(), serverId)
+		c.JSON(http.StatusOK, JobResponse{Success: true, JobId: job.Id, Coalesced: !started})
 		return
 	} else if from == "sav" {
-		go task.SavSyncByServer(serverId)
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		job, started := task.SavSyncByServer(serverId, c.Query("force") == "true")
+		c.JSON(http.StatusOK, JobResponse{Success: true, JobId: job.Id, Coalesced: !started})
 		return
 	}
 	c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from parameter"})
@@ -990,6 +1007,113 @@ func listBackupsByServer(c *gin.Context) {
 	c.JSON(http.StatusOK, backups)
 }
 
+type BackupCreateRequest struct {
+	Label  string `json:"label"`
+	Note   string `json:"note"`
+	Pinned bool   `json:"pinned"`
+}
+
+type BackupUpdateRequest struct {
+	Label  *string `json:"label"`
+	Note   *string `json:"note"`
+	Pinned *bool   `json:"pinned"`
+}
+
+// createBackupByServer godoc
+//
+//	@Summary		Create Backup By Server
+//	@Description	Create a manual backup with an optional label and note, e.g. before a game update
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string				true	"Server ID"
+//	@Param			backup		body		BackupCreateRequest	false	"Backup"
+//	@Success		201			{object}	database.Backup
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Failure		409			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups [post]
+func createBackupByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	server, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	var req BackupCreateRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var backup *database.Backup
+	job, started := task.RunJob(serverId, task.JobKindBackup, func() error {
+		var err error
+		backup, err = tool.NewBackupWithConfig(database.GetDB(), server, tool.BackupOptions{
+			Trigger: database.BackupTriggerManual,
+			Label:   req.Label,
+			Note:    req.Note,
+			Pinned:  req.Pinned,
+		})
+		return err
+	})
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "a backup is already running for this server, job " + job.Id})
+		return
+	}
+	if job.State == task.JobStateFailed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": job.Error})
+		return
+	}
+	c.JSON(http.StatusCreated, backup)
+}
+
+// updateBackupByServer godoc
+//
+//	@Summary		Update Backup By Server
+//	@Description	Update the label, note or pinned flag of a backup. Pinned backups are never removed by retention.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string				true	"Server ID"
+//	@Param			backup_id	path		string				true	"Backup ID"
+//	@Param			backup		body		BackupUpdateRequest	true	"Backup"
+//	@Success		200			{object}	database.Backup
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id} [put]
+func updateBackupByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	_, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	var req BackupUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	backup, err := service.UpdateBackupMetaByServer(database.GetDB(), serverId, backupId, req.Label, req.Note, req.Pinned)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, backup)
+}
+
 // downloadBackupByServer godoc
 //
 //	@Summary		Download Backup By Server
@@ -1024,13 +1148,17 @@ func downloadBackupByServer(c *gin.Context) {
 		return
 	}
 
-	backupDir, err := tool.GetBackupDir()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strings.TrimSuffix(backup.Path, ".enc")))
+	c.Header("Content-Type", "application/zip")
+	if err := tool.WriteBackupByServer(backup, c.Writer); err != nil {
+		if !c.Writer.Written() {
+			c.Header("Content-Disposition", "")
+			c.Header("Content-Type", "")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Errorf("Failed to send backup %s of server %s: %v\n", backup.Path, serverId, err)
 	}
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", backup.Path))
-	c.File(filepath.Join(backupDir, backup.Path))
 }
 
 // deleteBackupByServer godoc
@@ -1069,12 +1197,7 @@ func deleteBackupByServer(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	backupDir, err := tool.GetBackupDir()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	err = os.Remove(filepath.Join(backupDir, backup.Path))
+	err = tool.DeleteBackupFilesByServer(backup)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+	"github.com/zaigie/palworld-server-tool/service"
+)
+
+type RestoreResponse struct {
+	RestoreId string `json:"restore_id"`
+}
+
+// restoreBackupByServer godoc
+//
+//	@Summary		Restore Backup By Server
+//	@Description	Restore a backup onto the server save. A safety backup of the current save is taken first.
+//	@Description	With dry_run the files that would be replaced are returned and nothing is changed.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string				true	"Server ID"
+//	@Param			backup_id	path		string				true	"Backup ID"
+//	@Param			options		body		tool.RestoreOptions	false	"Restore options"
+//	@Success		200			{object}	tool.RestorePlan
+//	@Success		202			{object}	RestoreResponse
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Failure		409			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/restore [post]
+func restoreBackupByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	server, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	var opts tool.RestoreOptions
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	db := database.GetDB()
+	backup, err := service.GetBackupByServer(db, serverId, backupId)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if opts.DryRun {
+		plan, tempDir, err := tool.PlanRestoreWithConfig(server, backup, opts.Files)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		os.RemoveAll(tempDir)
+		c.JSON(http.StatusOK, plan)
+		return
+	}
+
+	restoreId, err := tool.StartRestoreWithConfig(db, server, backup, opts)
+	if err != nil {
+		if err == tool.ErrRestoreRunning {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"restore_id": restoreId})
+}
+
+// getRestoreByServer godoc
+//
+//	@Summary		Get Restore Progress By Server
+//	@Description	Get the progress of a backup restore
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Param			restore_id	path		string	true	"Restore ID"
+//	@Success		200			{object}	tool.RestoreProgress
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/restores/{restore_id} [get]
+func getRestoreByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	restoreId := c.Param("restore_id")
+	if _, exists := config.GetServer(serverId); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	progress, ok := tool.GetRestoreProgress(restoreId)
+	if !ok || progress.ServerId != serverId {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Restore not found"})
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+// verifyBackupByServer godoc
+//
+//	@Summary		Verify Backup By Server
+//	@Description	Re-read a backup and check its checksums and save headers. The result is recorded on the backup.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	path		string	true	"Server ID"
+//	@Param			backup_id	path		string	true	"Backup ID"
+//	@Success		200			{object}	database.Backup
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/{backup_id}/verify [post]
+func verifyBackupByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	backupId := c.Param("backup_id")
+	if _, exists := config.GetServer(serverId); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	db := database.GetDB()
+	backup, err := service.GetBackupByServer(db, serverId, backupId)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// a failed verification is reported through the verify_status of the backup
+	tool.VerifyBackupByServer(db, backup)
+	c.JSON(http.StatusOK, backup)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+	"github.com/zaigie/palworld-server-tool/service"
+)
+
+type RetentionPreviewResponse struct {
+	Policy   config.BackupRetention   `json:"policy"`
+	KeepDays int                      `json:"keep_days"`
+	Keep     int                      `json:"keep"`
+	Delete   int                      `json:"delete"`
+	Backups  []tool.RetentionDecision `json:"backups"`
+}
+
+// previewBackupRetentionByServer godoc
+//
+//	@Summary		Preview Backup Retention By Server
+//	@Description	Show which backups the retention policy keeps and which it would delete on the next run.
+//	@Description	Query parameters override the configured policy, so a new policy can be tried before it is saved.
+//	@Tags			backup
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id		path		string	true	"Server ID"
+//	@Param			keep_all_hours	query		int		false	"Keep every backup from the last hours"
+//	@Param			daily			query		int		false	"Keep one backup per day for this many days"
+//	@Param			weekly			query		int		false	"Keep one backup per week for this many weeks"
+//	@Param			monthly			query		int		false	"Keep one backup per month for this many months"
+//	@Param			keep_days		query		int		false	"Keep days used when no policy is set"
+//	@Success		200				{object}	RetentionPreviewResponse
+//	@Failure		400				{object}	ErrorResponse
+//	@Failure		404				{object}	ErrorResponse
+//	@Router			/api/servers/{server_id}/backups/retention [get]
+func previewBackupRetentionByServer(c *gin.Context) {
+	serverId := c.Param("server_id")
+	server, exists := config.GetServer(serverId)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	policy := server.Save.BackupRetention
+	keepDays := server.Save.BackupKeepDays
+	for name, value := range map[string]*int{
+		"keep_all_hours": &policy.KeepAllHours,
+		"daily":          &policy.Daily,
+		"weekly":         &policy.Weekly,
+		"monthly":        &policy.Monthly,
+		"keep_days":      &keepDays,
+	} {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+			return
+		}
+		*value = n
+	}
+	if keepDays == 0 {
+		keepDays = 7
+	}
+
+	backups, err := service.ListBackupsByServer(database.GetDB(), serverId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	decisions := tool.PlanBackupRetention(backups, policy, keepDays, time.Now())
+	response := RetentionPreviewResponse{
+		Policy:   policy,
+		KeepDays: keepDays,
+		Backups:  decisions,
+	}
+	for _, decision := range decisions {
+		if decision.Keep {
+			response.Keep++
+		} else {
+			response.Delete++
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -58,6 +58,8 @@ func RegisterRouter(r *gin.Engine) {
 	r.Use(Logger(), gin.Recovery())
 
 	r.POST("/api/login", loginHandler)
+	// pst-agent pushes with the ingest token of the server instead of a login
+	r.POST("/api/servers/:server_id/ingest", ingestSaveByServer)
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	apiGroup := r.Group("/api")
@@ -135,6 +137,13 @@ func RegisterRouter(r *gin.Engine) {
 		authGroup.POST("/servers/:server_id/players/:player_uid/unban", unbanPlayerByServer)
 		authGroup.PUT("/servers/:server_id/guilds", putGuildsByServer)
 		authGroup.POST("/servers/:server_id/sync", syncDataByServer)
+		authGroup.GET("/jobs", listJobs)
+		authGroup.GET("/jobs/:job_id", getJob)
+		authGroup.GET("/tasks", listTasks)
+		authGroup.POST("/tasks/:name/pause", pauseTask)
+		authGroup.POST("/tasks/:name/resume", resumeTask)
+		authGroup.POST("/tasks/:name/run", runTask)
+		authGroup.PUT("/tasks/:name/interval", putTaskInterval)
 		authGroup.GET("/servers/:server_id/whitelist", listWhiteByServer)
 		authGroup.POST("/servers/:server_id/whitelist", addWhiteByServer)
 		authGroup.DELETE("/servers/:server_id/whitelist", removeWhiteByServer)
@@ -146,7 +155,19 @@ func RegisterRouter(r *gin.Engine) {
 		authGroup.PUT("/servers/:server_id/rcon/:uuid", putRconCommandByServer)
 		authGroup.DELETE("/servers/:server_id/rcon/:uuid", removeRconCommandByServer)
 		authGroup.GET("/servers/:server_id/backups", listBackupsByServer)
+		authGroup.POST("/servers/:server_id/backups", createBackupByServer)
+		authGroup.GET("/servers/:server_id/backups/retention", previewBackupRetentionByServer)
 		authGroup.GET("/servers/:server_id/backups/:backup_id", downloadBackupByServer)
+		authGroup.PUT("/servers/:server_id/backups/:backup_id", updateBackupByServer)
 		authGroup.DELETE("/servers/:server_id/backups/:backup_id", deleteBackupByServer)
+		authGroup.POST("/servers/:server_id/backups/:backup_id/restore", restoreBackupByServer)
+		authGroup.POST("/servers/:server_id/backups/:backup_id/verify", verifyBackupByServer)
+		authGroup.GET("/servers/:server_id/backups/:backup_id/files", listBackupFilesByServer)
+		authGroup.GET("/servers/:server_id/backups/:backup_id/file", downloadBackupFileByServer)
+		authGroup.POST("/servers/:server_id/backups/:backup_id/players/:player_uid/restore", restorePlayerByServer)
+		authGroup.GET("/servers/:server_id/backups/:backup_id/diff/:other_id", diffBackupsByServer)
+		authGroup.GET("/servers/:server_id/restores/:restore_id", getRestoreByServer)
+		authGroup.GET("/backup-store/check", checkBackupStore)
+		authGroup.POST("/backup-store/gc", gcBackupStore)
 	}
 }
@@ -31,6 +31,8 @@ type BroadcastRequest struct {
 type ShutdownRequest struct {
 	Seconds int    `json:"seconds"`
 	Message string `json:"message"`
+	// Backup takes a pre-shutdown backup first, multi-server endpoint only
+	Backup bool `json:"backup"`
 }
 
 type ServerToolResponse struct {
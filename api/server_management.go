@@ -3,6 +3,7 @@ package api
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/task"
 	"github.com/zaigie/palworld-server-tool/internal/tool"
 	"net/http"
 )
@@ -204,6 +205,9 @@ func createServer(c *gin.Context) {
 		if decodePath, ok := saveConfig["decode_path"].(string); ok {
 			newServer.Save.DecodePath = decodePath
 		}
+		if ingestToken, ok := saveConfig["ingest_token"].(string); ok {
+			newServer.Save.IngestToken = ingestToken
+		}
 		if syncInterval, ok := saveConfig["sync_interval"].(float64); ok {
 			newServer.Save.SyncInterval = int(syncInterval)
 		}
@@ -213,11 +217,21 @@ func createServer(c *gin.Context) {
 		if backupKeepDays, ok := saveConfig["backup_keep_days"].(float64); ok {
 			newServer.Save.BackupKeepDays = int(backupKeepDays)
 		}
+		if backupPreSave, ok := saveConfig["backup_pre_save"].(bool); ok {
+			newServer.Save.BackupPreSave = backupPreSave
+		}
+		if backupFormat, ok := saveConfig["backup_format"].(string); ok {
+			newServer.Save.BackupFormat = backupFormat
+		}
+		if retention, ok := saveConfig["backup_retention"].(map[string]interface{}); ok {
+			parseBackupRetention(retention, &newServer.Save.BackupRetention)
+		}
 	}
 
 	// Add to configuration
 	globalConfig := config.GetConfig()
 	globalConfig.Servers = append(globalConfig.Servers, newServer)
+	task.RefreshTasks()
 
 	c.JSON(http.StatusCreated, gin.H{"success": true})
 }
@@ -310,6 +324,9 @@ func updateServer(c *gin.Context) {
 			if decodePath, ok := saveConfig["decode_path"].(string); ok {
 				server.Save.DecodePath = decodePath
 			}
+			if ingestToken, ok := saveConfig["ingest_token"].(string); ok {
+				server.Save.IngestToken = ingestToken
+			}
 			if syncInterval, ok := saveConfig["sync_interval"].(float64); ok {
 				server.Save.SyncInterval = int(syncInterval)
 			}
@@ -319,8 +336,18 @@ func updateServer(c *gin.Context) {
 			if backupKeepDays, ok := saveConfig["backup_keep_days"].(float64); ok {
 				server.Save.BackupKeepDays = int(backupKeepDays)
 			}
+			if backupPreSave, ok := saveConfig["backup_pre_save"].(bool); ok {
+				server.Save.BackupPreSave = backupPreSave
+			}
+			if backupFormat, ok := saveConfig["backup_format"].(string); ok {
+				server.Save.BackupFormat = backupFormat
+			}
+			if retention, ok := saveConfig["backup_retention"].(map[string]interface{}); ok {
+				parseBackupRetention(retention, &server.Save.BackupRetention)
+			}
 		}
 	}
+	task.RefreshTasks()
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
@@ -357,8 +384,24 @@ func deleteServer(c *gin.Context) {
 
 	// Remove server from configuration
 	globalConfig.Servers = append(globalConfig.Servers[:serverIndex], globalConfig.Servers[serverIndex+1:]...)
+	task.RefreshTasks()
 
 	// TODO: Clean up associated data from database
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
+
+func parseBackupRetention(retentionConfig map[string]interface{}, retention *config.BackupRetention) {
+	if keepAllHours, ok := retentionConfig["keep_all_hours"].(float64); ok {
+		retention.KeepAllHours = int(keepAllHours)
+	}
+	if daily, ok := retentionConfig["daily"].(float64); ok {
+		retention.Daily = int(daily)
+	}
+	if weekly, ok := retentionConfig["weekly"].(float64); ok {
+		retention.Weekly = int(weekly)
+	}
+	if monthly, ok := retentionConfig["monthly"].(float64); ok {
+		retention.Monthly = int(monthly)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/config"
 	"github.com/zaigie/palworld-server-tool/internal/database"
 	"github.com/zaigie/palworld-server-tool/internal/task"
 )
@@ -18,26 +19,34 @@ const (
 // syncData godoc
 //
 //	@Summary		Sync Data
-//	@Description	Sync Data
+//	@Description	Start a sync job for every enabled server, poll them with /api/jobs/{job_id}
 //	@Tags			Sync
 //	@Accept			json
 //	@Produce		json
 //	@Security		ApiKeyAuth
 //	@Param			from	query		From	true	"from"	enum(rest,sav)
+//	@Param			force	query		bool	false	"Decode saves even when unchanged"
 //
-//	@Success		200		{object}	SuccessResponse
+//	@Success		200		{object}	JobsResponse
 //	@Failure		401		{object}	ErrorResponse
 //	@Router			/api/sync [post]
 func syncData(c *gin.Context) {
 	from := c.Query("from")
-	if from == "rest" {
-		go task.PlayerSync(database.GetDB())
-		c.JSON(http.StatusOK, gin.H{"success": true})
-		return
-	} else if from == "sav" {
-		go task.SavSync()
-		c.JSON(http.StatusOK, gin.H{"success": true})
+	if from != "rest" && from != "sav" {
+		c.JSON(http.StatusOK, gin.H{"error": "invalid from"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"error": "invalid from"})
+	jobIds := []string{}
+	for _, server := range config.GetEnabledServers() {
+		var job task.Job
+		if from == "rest" {
+			job, _ = task.PlayerSyncByServer(database.GetDB(), server.Id)
+		} else if server.Save.Path != "" {
+			job, _ = task.SavSyncByServer(server.Id, c.Query("force") == "true")
+		} else {
+			continue
+		}
+		jobIds = append(jobIds, job.Id)
+	}
+	c.JSON(http.StatusOK, JobsResponse{Success: true, JobIds: jobIds})
 }
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/task"
+)
+
+type TaskIntervalRequest struct {
+	// Interval in seconds, 0 goes back to the configured interval
+	Interval *int `json:"interval" binding:"required"`
+}
+
+// listTasks godoc
+//
+//	@Summary		List Tasks
+//	@Description	List the scheduled tasks with their interval, next run and last result
+//	@Tags			Task
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			server_id	query		string	false	"Server ID"
+//	@Success		200			{array}		task.TaskInfo
+//	@Failure		401			{object}	ErrorResponse
+//	@Router			/api/tasks [get]
+func listTasks(c *gin.Context) {
+	serverId := c.Query("server_id")
+	tasks := make([]task.TaskInfo, 0)
+	for _, info := range task.ListTasks() {
+		if serverId == "" || info.ServerId == serverId {
+			tasks = append(tasks, info)
+		}
+	}
+	c.JSON(http.StatusOK, tasks)
+}
+
+// pauseTask godoc
+//
+//	@Summary		Pause Task
+//	@Description	Stop running a scheduled task until it is resumed, also after a restart
+//	@Tags			Task
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			name	path		string	true	"Task Name"
+//	@Success		200		{object}	task.TaskInfo
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Router			/api/tasks/{name}/pause [post]
+func pauseTask(c *gin.Context) {
+	info, err := task.PauseTask(c.Param("name"))
+	taskResponse(c, info, err)
+}
+
+// resumeTask godoc
+//
+//	@Summary		Resume Task
+//	@Description	Schedule a paused task again
+//	@Tags			Task
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			name	path		string	true	"Task Name"
+//	@Success		200		{object}	task.TaskInfo
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Router			/api/tasks/{name}/resume [post]
+func resumeTask(c *gin.Context) {
+	info, err := task.ResumeTask(c.Param("name"))
+	taskResponse(c, info, err)
+}
+
+// runTask godoc
+//
+//	@Summary		Run Task
+//	@Description	Run a scheduled task now in the background, paused tasks included
+//	@Tags			Task
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			name	path		string	true	"Task Name"
+//	@Success		200		{object}	SuccessResponse
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Router			/api/tasks/{name}/run [post]
+func runTask(c *gin.Context) {
+	err := task.RunTaskNow(c.Param("name"))
+	if errors.Is(err, task.ErrTaskNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// putTaskInterval godoc
+//
+//	@Summary		Set Task Interval
+//	@Description	Override the configured interval of a scheduled task, 0 goes back to the configured interval
+//	@Tags			Task
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			name		path		string				true	"Task Name"
+//	@Param			interval	body		TaskIntervalRequest	true	"Interval in seconds"
+//	@Success		200			{object}	task.TaskInfo
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		401			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/tasks/{name}/interval [put]
+func putTaskInterval(c *gin.Context) {
+	var req TaskIntervalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if *req.Interval < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must not be negative"})
+		return
+	}
+	info, err := task.SetTaskInterval(c.Param("name"), *req.Interval)
+	taskResponse(c, info, err)
+}
+
+func taskResponse(c *gin.Context, info task.TaskInfo, err error) {
+	if errors.Is(err, task.ErrTaskNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
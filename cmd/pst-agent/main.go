@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
@@ -17,59 +22,216 @@ import (
 )
 
 var (
-	port     int
-	savedDir string
+	port       int
+	savedDir   string
+	token      string
+	tlsCert    string
+	tlsKey     string
+	allowedIPs string
+	instances  string
+	safetyDir  string
+	pushUrl    string
+	serverId   string
+	settle     int
+	// insecureWrite allows write-back when the agent serves plain http
+	insecureWrite bool
 )
 
 func main() {
 	flag.IntVar(&port, "port", 8081, "port")
 	flag.StringVar(&savedDir, "d", "", "Directory containing Level.sav file")
+	flag.StringVar(&token, "token", "", "Token PST must send, as is or as HMAC signature")
+	flag.StringVar(&tlsCert, "cert", "", "TLS certificate file, serves https together with -key")
+	flag.StringVar(&tlsKey, "key", "", "TLS private key file")
+	flag.StringVar(&allowedIPs, "allow", "", "Comma separated IPs or CIDRs allowed to connect, all when empty")
+	flag.StringVar(&instances, "instances", "", "Comma separated name=directory pairs served at /sync/<name>")
+	flag.StringVar(&safetyDir, "safety-dir", "", "Where the save is copied before a write-back, default safety next to the agent")
+	flag.StringVar(&pushUrl, "push", "", "PST address to push the save to whenever it changes, e.g. http://pst:8080")
+	flag.StringVar(&serverId, "server", "", "Server id the pushed save belongs to")
+	flag.IntVar(&settle, "settle", 10, "Seconds the save files must stay unchanged before pushing")
+	flag.BoolVar(&insecureWrite, "insecure-write", false, "Allow write-back without TLS, e.g. behind a reverse proxy terminating TLS")
 	flag.Parse()
 
 	viper.BindEnv("saved_dir", "SAVED_DIR")
+	viper.BindEnv("token", "AGENT_TOKEN")
+	viper.BindEnv("tls_cert", "TLS_CERT")
+	viper.BindEnv("tls_key", "TLS_KEY")
+	viper.BindEnv("allowed_ips", "ALLOWED_IPS")
+	viper.BindEnv("instances", "INSTANCES")
+	viper.BindEnv("safety_dir", "SAFETY_DIR")
+	viper.BindEnv("push_url", "PUSH_URL")
+	viper.BindEnv("server_id", "SERVER_ID")
+	viper.BindEnv("settle", "SETTLE_SECONDS")
+	viper.BindEnv("insecure_write", "INSECURE_WRITE")
 	viper.SetDefault("port", port)
 	viper.SetDefault("saved_dir", savedDir)
+	viper.SetDefault("token", token)
+	viper.SetDefault("tls_cert", tlsCert)
+	viper.SetDefault("tls_key", tlsKey)
+	viper.SetDefault("allowed_ips", allowedIPs)
+	viper.SetDefault("instances", instances)
+	viper.SetDefault("safety_dir", safetyDir)
+	viper.SetDefault("push_url", pushUrl)
+	viper.SetDefault("server_id", serverId)
+	viper.SetDefault("settle", settle)
+	viper.SetDefault("insecure_write", insecureWrite)
 	savedDir = viper.GetString("saved_dir")
-
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-
-	r.GET("/sync", func(c *gin.Context) {
-
-		levelFile, err := source.CopyFromLocal(savedDir, "agent")
+	token = viper.GetString("token")
+	tlsCert = viper.GetString("tls_cert")
+	tlsKey = viper.GetString("tls_key")
+	safetyDir = viper.GetString("safety_dir")
+	pushUrl = viper.GetString("push_url")
+	serverId = viper.GetString("server_id")
+	settle = viper.GetInt("settle")
+	insecureWrite = viper.GetBool("insecure_write")
+
+	var err error
+	instanceDirs, err = parseInstances(viper.GetString("instances"))
+	if err != nil {
+		logger.Errorf("Invalid instances: %v\n", err)
+		os.Exit(1)
+	}
+	if safetyDir == "" {
+		execDir, err := system.GetExecDir()
 		if err != nil {
-			logger.Errorf("Failed to get directory include Level.sav: %v\n", err)
+			logger.Errorf("Failed to get exec directory: %v\n", err)
 			os.Exit(1)
 		}
-		cacheDir := filepath.Dir(levelFile)
-		defer os.RemoveAll(cacheDir)
-
-		cacheFile := cacheDir + ".zip"
-		err = system.ZipDir(cacheDir, cacheFile)
-		if err != nil {
-			logger.Errorf("Failed to create zip: %v\n", err)
-			c.Redirect(http.StatusFound, "/404")
-			return
-		}
-		defer os.Remove(cacheFile)
+		safetyDir = filepath.Join(execDir, "safety")
+	}
+
+	allowed, err := parseAllowedIPs(viper.GetString("allowed_ips"))
+	if err != nil {
+		logger.Errorf("Invalid allowed IPs: %v\n", err)
+		os.Exit(1)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		logger.Error("Both -cert and -key are required for TLS\n")
+		os.Exit(1)
+	}
+	if token == "" {
+		logger.Warn("No token set, anyone who can reach the agent can download the save, write-back is disabled\n")
+	}
+	if pushUrl != "" && (serverId == "" || token == "") {
+		logger.Error("Pushing needs -server and the -token set as save.ingest_token in PST\n")
+		os.Exit(1)
+	}
 
-		c.Header("Content-Disposition", "attachment; filename=sav.zip")
-		c.File(cacheFile)
-	})
-
-	logger.Infof("PST-Agent Listening on port %d\n", port)
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.Default()
+	// the allowlist checks the connecting address, forwarded headers are not trusted
+	r.SetTrustedProxies(nil)
+	r.Use(allowIPs(allowed), requireToken(token))
+
+	for _, prefix := range []string{"/sync", "/sync/:instance"} {
+		r.GET(prefix, syncSave)
+		r.HEAD(prefix, syncSave)
+		r.PUT(prefix, uploadSave)
+		r.GET(prefix+"/manifest", syncManifest)
+		r.GET(prefix+"/files/*name", syncFile)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		if err := r.Run(":" + strconv.Itoa(port)); err != nil {
+		var err error
+		if tlsCert != "" {
+			logger.Infof("PST-Agent Listening on port %d with TLS\n", port)
+			err = r.RunTLS(":"+strconv.Itoa(port), tlsCert, tlsKey)
+		} else {
+			logger.Infof("PST-Agent Listening on port %d\n", port)
+			err = r.Run(":" + strconv.Itoa(port))
+		}
+		if err != nil {
 			logger.Errorf("Failed to start agent: %v\n", err)
 		}
 	}()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	if pushUrl != "" {
+		go pushSaves(ctx, pushUrl, serverId, token, time.Duration(settle)*time.Second)
+	}
+
 	<-sigChan
+	cancel()
 
 	logger.Info("PST-Agent gracefully stopped\n")
 
 }
+
+// parseAllowedIPs parses a comma separated list of IPs and CIDRs
+func parseAllowedIPs(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+func allowIPs(allowed []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(allowed) == 0 {
+			return
+		}
+		addr, err := netip.ParseAddr(c.RemoteIP())
+		if err == nil {
+			addr = addr.Unmap()
+			for _, prefix := range allowed {
+				if prefix.Contains(addr) {
+					return
+				}
+			}
+		}
+		logger.Warnf("Rejected request from %s\n", c.RemoteIP())
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "address not allowed"})
+	}
+}
+
+func requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			return
+		}
+		if err := source.VerifyAgentRequest(c.Request, token); err != nil {
+			logger.Warnf("Rejected request from %s: %v\n", c.RemoteIP(), err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
+	}
+}
+
+// parseInstances parses comma separated name=directory pairs
+func parseInstances(list string) (map[string]string, error) {
+	dirs := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, dir, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("%s is not name=directory", entry)
+		}
+		if name == "manifest" || name == "files" || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("invalid instance name %s", name)
+		}
+		dirs[name] = dir
+	}
+	return dirs, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+const pushAttempts = 3
+
+// pushSaves uploads the save to the ingest endpoint of PST at start and whenever it
+// changed and settled, until ctx is done
+func pushSaves(ctx context.Context, pstUrl, serverId, token string, settle time.Duration) {
+	ingestUrl := strings.TrimSuffix(pstUrl, "/") + "/api/servers/" + url.PathEscape(serverId) + "/ingest"
+	auth := source.AgentAuth{Token: token}
+	driver := &source.LocalDriver{Path: savedDir}
+	lastETag := ""
+
+	pushIfChanged := func() {
+		savDir, err := driver.SavDir()
+		if err != nil {
+			logger.Errorf("Failed to get directory include Level.sav: %v\n", err)
+			return
+		}
+		manifest, err := source.BuildAgentManifest(savDir)
+		if err != nil {
+			logger.Errorf("Failed to hash save files: %v\n", err)
+			return
+		}
+		if manifest.ETag == lastETag {
+			return
+		}
+		for attempt := 1; attempt <= pushAttempts; attempt++ {
+			if err = pushSave(ingestUrl, auth); err == nil {
+				lastETag = manifest.ETag
+				logger.Infof("Save pushed to %s\n", ingestUrl)
+				return
+			}
+			logger.Warnf("Failed to push save (attempt %d/%d): %v\n", attempt, pushAttempts, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * 10 * time.Second):
+			}
+		}
+	}
+
+	logger.Infof("Pushing save to %s on changes\n", ingestUrl)
+	pushIfChanged()
+	err := driver.Watch(ctx, func(stat source.Stat) {
+		savDir, err := driver.SavDir()
+		if err != nil {
+			logger.Errorf("Failed to get directory include Level.sav: %v\n", err)
+			return
+		}
+		// the game writes Level.sav and the player saves one after another
+		if err = system.WaitForSavSettle(savDir, stat.ModTime, settle, settle+time.Minute); err != nil {
+			logger.Warnf("Pushing unsettled save: %v\n", err)
+		}
+		pushIfChanged()
+	})
+	if err != nil {
+		logger.Errorf("Failed to watch save: %v\n", err)
+	}
+}
+
+// pushSave uploads the save as sav.zip
+func pushSave(ingestUrl string, auth source.AgentAuth) error {
+	levelFile, err := source.CopyFromLocal(savedDir, "push")
+	if err != nil {
+		return err
+	}
+	cacheDir := filepath.Dir(levelFile)
+	defer os.RemoveAll(cacheDir)
+
+	cacheFile := cacheDir + ".zip"
+	if err = system.ZipDir(cacheDir, cacheFile); err != nil {
+		return err
+	}
+	defer os.Remove(cacheFile)
+	_, checksum, err := system.Sha256File(cacheFile)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(cacheFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	req, err := http.NewRequest(http.MethodPost, ingestUrl, file)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set(source.AgentBodyHashHeader, checksum)
+	auth.Sign(req)
+
+	client, err := auth.Client()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
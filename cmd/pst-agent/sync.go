@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+// instanceDirs maps the instances served at /sync/<name> to their save directories,
+// /sync itself serves -d
+var instanceDirs map[string]string
+
+// instanceDir returns the save directory of the instance in the request path
+func instanceDir(c *gin.Context) (string, bool) {
+	name := c.Param("instance")
+	dir := savedDir
+	if name != "" {
+		dir = instanceDirs[name]
+	}
+	if dir == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "instance not found"})
+		return "", false
+	}
+	return dir, true
+}
+
+// locateManifest hashes the save files and answers 304 when If-None-Match still matches
+func locateManifest(c *gin.Context) (string, source.AgentManifest, bool) {
+	dir, ok := instanceDir(c)
+	if !ok {
+		return "", source.AgentManifest{}, false
+	}
+	savDir, err := source.LocateLocalSavDir(dir)
+	if err != nil {
+		logger.Errorf("Failed to get directory include Level.sav: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", source.AgentManifest{}, false
+	}
+	manifest, err := source.BuildAgentManifest(savDir)
+	if err != nil {
+		logger.Errorf("Failed to hash save files: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", source.AgentManifest{}, false
+	}
+	c.Header("ETag", `"`+manifest.ETag+`"`)
+	if source.MatchETag(c.GetHeader("If-None-Match"), manifest.ETag) {
+		c.Status(http.StatusNotModified)
+		return "", source.AgentManifest{}, false
+	}
+	return savDir, manifest, true
+}
+
+// syncSave sends the save as sav.zip
+func syncSave(c *gin.Context) {
+	savDir, _, ok := locateManifest(c)
+	if !ok {
+		return
+	}
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	levelFile, err := source.CopyFromLocal(savDir, "agent")
+	if err != nil {
+		logger.Errorf("Failed to get directory include Level.sav: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cacheDir := filepath.Dir(levelFile)
+	defer os.RemoveAll(cacheDir)
+
+	cacheFile := cacheDir + ".zip"
+	err = system.ZipDir(cacheDir, cacheFile)
+	if err != nil {
+		logger.Errorf("Failed to create zip: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(cacheFile)
+
+	// lets PST verify the archive before extracting it
+	_, checksum, err := system.Sha256File(cacheFile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("X-Content-Sha256", checksum)
+	c.Header("Content-Disposition", "attachment; filename=sav.zip")
+	c.File(cacheFile)
+}
+
+// syncManifest lists the save files with their hashes, so PST downloads only changed files
+func syncManifest(c *gin.Context) {
+	if _, manifest, ok := locateManifest(c); ok {
+		c.JSON(http.StatusOK, manifest)
+	}
+}
+
+// syncFile sends a single file listed by the manifest
+func syncFile(c *gin.Context) {
+	dir, ok := instanceDir(c)
+	if !ok {
+		return
+	}
+	savDir, err := source.LocateLocalSavDir(dir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	names, err := system.ListSavFiles(savDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	for _, file := range names {
+		if file == name {
+			c.File(filepath.Join(savDir, filepath.FromSlash(name)))
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+}
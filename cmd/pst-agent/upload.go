@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+const (
+	// maxUploadSize limits the size of an uploaded sav.zip
+	maxUploadSize = 1 << 30
+	// safetyCopies is how many safety copies are kept per instance
+	safetyCopies = 5
+)
+
+// uploadMu serializes write-backs
+var uploadMu sync.Mutex
+
+// uploadSave replaces the save files of an instance with the .sav files of the uploaded
+// zip, copying the current files to the safety directory first
+func uploadSave(c *gin.Context) {
+	if token == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "write-back needs the agent to run with -token"})
+		return
+	}
+	if tlsCert == "" && !insecureWrite {
+		c.JSON(http.StatusForbidden, gin.H{"error": "write-back needs the agent to serve TLS with -cert and -key, or -insecure-write"})
+		return
+	}
+	dir, ok := instanceDir(c)
+	if !ok {
+		return
+	}
+	savDir, err := source.LocateLocalSavDir(dir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-upload-"+uuid.New().String())
+	defer os.RemoveAll(tempDir)
+	zipFile := tempDir + ".zip"
+	defer os.Remove(zipFile)
+	out, err := os.Create(zipFile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = io.Copy(out, http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize))
+	out.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err = system.UnzipDir(zipFile, tempDir); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "error extracting zip: " + err.Error()})
+		return
+	}
+	names, err := system.ListSavFiles(tempDir)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(names) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "zip contains no save files"})
+		return
+	}
+	for _, name := range names {
+		if err = system.CheckSavHeader(filepath.Join(tempDir, filepath.FromSlash(name))); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": name + ": " + err.Error()})
+			return
+		}
+	}
+
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	instance := c.Param("instance")
+	if instance == "" {
+		instance = "default"
+	}
+	safetyCopy, err := copyToSafety(savDir, filepath.Join(safetyDir, instance))
+	if err != nil {
+		logger.Errorf("Failed to create safety copy: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error creating safety copy: " + err.Error()})
+		return
+	}
+	if err = source.CopyToLocal(tempDir, savDir); err != nil {
+		logger.Errorf("Failed to write save, the previous files are in %s: %v\n", safetyCopy, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "safety_copy": safetyCopy})
+		return
+	}
+	logger.Infof("Wrote %d save files to %s, safety copy in %s\n", len(names), savDir, safetyCopy)
+	c.JSON(http.StatusOK, gin.H{"files": names, "safety_copy": safetyCopy})
+}
+
+// copyToSafety copies the save files of savDir into a new timestamped directory below
+// dir and removes all but the newest safetyCopies copies
+func copyToSafety(savDir, dir string) (string, error) {
+	names, err := system.ListSavFiles(savDir)
+	if err != nil {
+		return "", err
+	}
+	copyDir := filepath.Join(dir, time.Now().Format("20060102-150405.000"))
+	for _, name := range names {
+		dist := filepath.Join(copyDir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(dist), 0755); err != nil {
+			return "", err
+		}
+		if err = system.CopyFile(filepath.Join(savDir, filepath.FromSlash(name)), dist); err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return copyDir, nil
+	}
+	var copies []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			copies = append(copies, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(copies)))
+	for i := safetyCopies; i < len(copies); i++ {
+		os.RemoveAll(filepath.Join(dir, copies[i]))
+	}
+	return copyDir, nil
+}
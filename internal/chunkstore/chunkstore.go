@@ -0,0 +1,613 @@
+package chunkstore
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
+)
+
+// ChunkSize is the size files are split at before hashing
+const ChunkSize = 4 << 20
+
+var (
+	ErrNoManifest  = errors.New("manifest not found")
+	ErrChecksum    = errors.New("checksum mismatch")
+	ErrInvalidName = errors.New("invalid name")
+)
+
+// Store keeps files as zlib compressed chunks addressed by the sha256 of their
+// content, so a file shared by several backups is stored once. Each backup is
+// described by a manifest listing its files and their chunks. With a key the
+// chunks are encrypted, ids stay the checksum of the plain content.
+type Store struct {
+	dir string
+	key *crypt.Key
+	// mu keeps gc from removing chunks of a manifest that is being written
+	mu sync.RWMutex
+}
+
+type Manifest struct {
+	Version   int            `json:"version"`
+	Name      string         `json:"name"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Sha256  string      `json:"sha256"`
+	Chunks  []string    `json:"chunks"`
+}
+
+type GCResult struct {
+	RemovedChunks int   `json:"removed_chunks"`
+	FreedBytes    int64 `json:"freed_bytes"`
+}
+
+type CheckResult struct {
+	Manifests int      `json:"manifests"`
+	Chunks    int      `json:"chunks"`
+	Missing   []string `json:"missing"`
+	Corrupt   []string `json:"corrupt"`
+	// Damaged lists the manifests referencing a missing or corrupt chunk
+	Damaged []string `json:"damaged"`
+}
+
+// Size returns the total size of the files in the manifest
+func (m *Manifest) Size() int64 {
+	var size int64
+	for _, file := range m.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// Open returns the store rooted at dir, creating it when needed. New chunks
+// are encrypted with key unless it is nil.
+func Open(dir string, key *crypt.Key) (*Store, error) {
+	for _, sub := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir, key: key}, nil
+}
+
+func (s *Store) chunkPath(id string) string {
+	return filepath.Join(s.dir, "chunks", id[:2], id)
+}
+
+func (s *Store) manifestPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || clean != name || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidName, name)
+	}
+	return filepath.Join(s.dir, "manifests", filepath.FromSlash(clean)+".json"), nil
+}
+
+// PutDir stores every regular file below srcDir under the manifest name
+func (s *Store) PutDir(name, srcDir string) (*Manifest, error) {
+	manifestFile, err := s.manifestPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	manifest := &Manifest{Version: 1, Name: name, CreatedAt: time.Now()}
+	err = filepath.Walk(srcDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return err
+		}
+		entry, err := s.putFile(file)
+		if err != nil {
+			return err
+		}
+		entry.Name = filepath.ToSlash(rel)
+		entry.Mode = info.Mode().Perm()
+		entry.ModTime = info.ModTime()
+		manifest.Files = append(manifest.Files, *entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(manifestFile, data); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (s *Store) putFile(file string) (*ManifestFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &ManifestFile{Chunks: []string{}}
+	fileHash := sha256.New()
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			fileHash.Write(buf[:n])
+			id, err := s.putChunk(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			entry.Chunks = append(entry.Chunks, id)
+			entry.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry.Sha256 = hex.EncodeToString(fileHash.Sum(nil))
+	return entry, nil
+}
+
+func (s *Store) putChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	chunkFile := s.chunkPath(id)
+	if _, err := os.Stat(chunkFile); err == nil {
+		return id, nil
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	data, err := s.seal(compressed.Bytes(), s.key)
+	if err != nil {
+		return "", err
+	}
+	return id, writeFileAtomic(chunkFile, data)
+}
+
+func (s *Store) seal(data []byte, key *crypt.Key) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	var sealed bytes.Buffer
+	w, err := crypt.Encrypt(&sealed, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return sealed.Bytes(), nil
+}
+
+func (s *Store) open(data []byte, key *crypt.Key) ([]byte, error) {
+	if !crypt.IsEncrypted(data) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, errors.New("chunk is encrypted but no backup encryption key is configured")
+	}
+	r, err := crypt.Decrypt(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func (s *Store) readChunk(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w: chunk %s", ErrInvalidName, id)
+	}
+	raw, err := os.ReadFile(s.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	raw, err = s.open(raw, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, ChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	sum := sha256.Sum256(data)
+	if len(data) > ChunkSize || hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("%w: chunk %s", ErrChecksum, id)
+	}
+	return data, nil
+}
+
+// GetManifest reads the manifest stored under name
+func (s *Store) GetManifest(name string) (*Manifest, error) {
+	manifestFile, err := s.manifestPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoManifest
+		}
+		return nil, err
+	}
+	var manifest Manifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	return &manifest, nil
+}
+
+// HasManifest reports whether a manifest is stored under name
+func (s *Store) HasManifest(name string) bool {
+	manifestFile, err := s.manifestPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(manifestFile)
+	return err == nil
+}
+
+// ManifestChecksum returns the sha256 of the stored manifest, which identifies
+// the whole backup since the manifest holds the checksum of every file
+func (s *Store) ManifestChecksum(name string) (string, error) {
+	manifestFile, err := s.manifestPath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// DeleteManifest removes a manifest. Its chunks stay until the next GC.
+func (s *Store) DeleteManifest(name string) error {
+	manifestFile, err := s.manifestPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(manifestFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes the content of a manifest file to w and checks its sha256
+func (s *Store) writeFile(entry ManifestFile, w io.Writer) error {
+	fileHash := sha256.New()
+	for _, id := range entry.Chunks {
+		data, err := s.readChunk(id)
+		if err != nil {
+			return err
+		}
+		fileHash.Write(data)
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	if hex.EncodeToString(fileHash.Sum(nil)) != entry.Sha256 {
+		return fmt.Errorf("%w: %s", ErrChecksum, entry.Name)
+	}
+	return nil
+}
+
+// WriteFile writes one file of a manifest to w
+func (s *Store) WriteFile(name, fileName string, w io.Writer) error {
+	manifest, err := s.GetManifest(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range manifest.Files {
+		if entry.Name == fileName {
+			return s.writeFile(entry, w)
+		}
+	}
+	return os.ErrNotExist
+}
+
+// Restore writes the files of a manifest below destDir
+func (s *Store) Restore(name, destDir string) error {
+	manifest, err := s.GetManifest(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range manifest.Files {
+		target := filepath.Join(destDir, filepath.FromSlash(entry.Name))
+		rel, err := filepath.Rel(destDir, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("%w: %s", ErrInvalidName, entry.Name)
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		mode := entry.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		err = s.writeFile(entry, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		os.Chtimes(target, entry.ModTime, entry.ModTime)
+	}
+	return nil
+}
+
+// WriteZip streams the files of a manifest to w as a zip archive
+func (s *Store) WriteZip(name string, w io.Writer) error {
+	manifest, err := s.GetManifest(name)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	for _, entry := range manifest.Files {
+		header := &zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Deflate,
+			Modified: entry.ModTime,
+		}
+		header.SetMode(entry.Mode)
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err = s.writeFile(entry, writer); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Verify re-reads every file of a manifest and checks the chunk and file checksums
+func (s *Store) Verify(name string) error {
+	manifest, err := s.GetManifest(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range manifest.Files {
+		if err = s.writeFile(entry, io.Discard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) listManifests() ([]string, error) {
+	root := filepath.Join(s.dir, "manifests")
+	var names []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(file, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		names = append(names, strings.TrimSuffix(filepath.ToSlash(rel), ".json"))
+		return nil
+	})
+	return names, err
+}
+
+// walkChunks calls fn for every chunk file in the store
+func (s *Store) walkChunks(fn func(id, file string, info os.FileInfo) error) error {
+	return filepath.Walk(filepath.Join(s.dir, "chunks"), func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		return fn(info.Name(), file, info)
+	})
+}
+
+// GC removes the chunks no manifest references
+func (s *Store) GC() (GCResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result GCResult
+	names, err := s.listManifests()
+	if err != nil {
+		return result, err
+	}
+	referenced := make(map[string]bool)
+	for _, name := range names {
+		manifest, err := s.GetManifest(name)
+		if err != nil {
+			// never collect while a manifest can't be read, its chunks would be lost
+			return result, err
+		}
+		for _, entry := range manifest.Files {
+			for _, id := range entry.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	err = s.walkChunks(func(id, file string, info os.FileInfo) error {
+		if referenced[id] {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		result.RemovedChunks++
+		result.FreedBytes += info.Size()
+		return nil
+	})
+	return result, err
+}
+
+// Check verifies every chunk referenced by a manifest is present and intact
+func (s *Store) Check() (CheckResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := CheckResult{Missing: []string{}, Corrupt: []string{}, Damaged: []string{}}
+	names, err := s.listManifests()
+	if err != nil {
+		return result, err
+	}
+	result.Manifests = len(names)
+
+	checked := make(map[string]error)
+	for _, name := range names {
+		manifest, err := s.GetManifest(name)
+		if err != nil {
+			result.Damaged = append(result.Damaged, name)
+			continue
+		}
+		damaged := false
+		for _, entry := range manifest.Files {
+			for _, id := range entry.Chunks {
+				chunkErr, ok := checked[id]
+				if !ok {
+					_, chunkErr = s.readChunk(id)
+					checked[id] = chunkErr
+					if os.IsNotExist(chunkErr) {
+						result.Missing = append(result.Missing, id)
+					} else if chunkErr != nil {
+						result.Corrupt = append(result.Corrupt, id)
+					}
+				}
+				if chunkErr != nil {
+					damaged = true
+				}
+			}
+		}
+		if damaged {
+			result.Damaged = append(result.Damaged, name)
+		}
+	}
+	result.Chunks = len(checked)
+	return result, nil
+}
+
+// Rekey re-encrypts every chunk with key and uses it for new chunks from then on.
+// A nil key decrypts the store. Chunks already sealed with key are skipped, so
+// an interrupted rekey can be run again.
+func (s *Store) Rekey(key *crypt.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.walkChunks(func(id, file string, info os.FileInfo) error {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if rekeyed(raw, key) {
+			// already under key, left by an interrupted earlier run
+			return nil
+		}
+		plain, err := s.open(raw, s.key)
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", id, err)
+		}
+		sealed, err := s.seal(plain, key)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(file, sealed)
+	})
+	if err != nil {
+		return err
+	}
+	s.key = key
+	return nil
+}
+
+// rekeyed reports whether a stored chunk is already sealed with key
+func rekeyed(raw []byte, key *crypt.Key) bool {
+	if !crypt.IsEncrypted(raw) {
+		return key == nil
+	}
+	if key == nil {
+		return false
+	}
+	r, err := crypt.Decrypt(bytes.NewReader(raw), key)
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err == nil
+}
+
+func writeFileAtomic(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tempFile := filepath.Join(filepath.Dir(file), ".tmp-"+uuid.New().String())
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err := os.Rename(tempFile, file); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package chunkstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
+)
+
+func putSave(t *testing.T, store *Store) map[string][]byte {
+	t.Helper()
+	srcDir := t.TempDir()
+	files := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("%d.sav", i)
+		files[name] = bytes.Repeat([]byte(name), 1000+i)
+		if err := os.WriteFile(filepath.Join(srcDir, name), files[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.PutDir("save", srcDir); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// interruptRekey seals half of the chunks with key the way Rekey does before it stops
+func interruptRekey(t *testing.T, store *Store, key *crypt.Key) {
+	t.Helper()
+	i := 0
+	err := store.walkChunks(func(id, file string, info os.FileInfo) error {
+		i++
+		if i%2 == 0 {
+			return nil
+		}
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		plain, err := store.open(raw, store.key)
+		if err != nil {
+			return err
+		}
+		sealed, err := store.seal(plain, key)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(file, sealed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i < 2 {
+		t.Fatalf("only %d chunks stored", i)
+	}
+}
+
+func assertRestores(t *testing.T, dir string, key *crypt.Key, files map[string][]byte) {
+	t.Helper()
+	store, err := Open(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Verify("save"); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+	if err = store.Restore("save", destDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs after the rekey", name)
+		}
+	}
+}
+
+func TestRekeyResume(t *testing.T) {
+	oldKey := crypt.NewPassphraseKey("old secret")
+	newKey := crypt.NewPassphraseKey("new secret")
+	tests := []struct {
+		name     string
+		from, to *crypt.Key
+	}{
+		{"encrypt", nil, newKey},
+		{"rotate", oldKey, newKey},
+		{"decrypt", oldKey, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := Open(dir, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := putSave(t, store)
+			interruptRekey(t, store, tt.to)
+
+			// the key in use is still the old one when the rekey is run again
+			store, err = Open(dir, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Rekey(tt.to); err != nil {
+				t.Fatalf("resumed rekey: %v", err)
+			}
+			err = store.walkChunks(func(id, file string, info os.FileInfo) error {
+				raw, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				if !rekeyed(raw, tt.to) {
+					t.Errorf("chunk %s not under the new key", id)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertRestores(t, dir, tt.to, files)
+
+			// running it once more changes nothing
+			if err = store.Rekey(tt.to); err != nil {
+				t.Fatalf("repeated rekey: %v", err)
+			}
+			assertRestores(t, dir, tt.to, files)
+		})
+	}
+}
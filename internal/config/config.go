@@ -25,13 +25,91 @@ type Server struct {
 		Password string `mapstructure:"password" json:"password"`
 		Timeout  int    `mapstructure:"timeout" json:"timeout"`
 	} `mapstructure:"rest" json:"rest"`
-	Save struct {
-		Path           string `mapstructure:"path" json:"path"`
-		DecodePath     string `mapstructure:"decode_path" json:"decode_path"`
-		SyncInterval   int    `mapstructure:"sync_interval" json:"sync_interval"`
-		BackupInterval int    `mapstructure:"backup_interval" json:"backup_interval"`
-		BackupKeepDays int    `mapstructure:"backup_keep_days" json:"backup_keep_days"`
-	} `mapstructure:"save" json:"save"`
+	Save Save `mapstructure:"save" json:"save"`
+}
+
+// Save holds the save file location and the sync/backup settings of a server
+type Save struct {
+	Path           string `mapstructure:"path" json:"path"`
+	DecodePath     string `mapstructure:"decode_path" json:"decode_path"`
+	SyncInterval   int    `mapstructure:"sync_interval" json:"sync_interval"`
+	BackupInterval int    `mapstructure:"backup_interval" json:"backup_interval"`
+	BackupKeepDays int    `mapstructure:"backup_keep_days" json:"backup_keep_days"`
+	// BackupPreSave asks the game server to save the world before each backup
+	BackupPreSave bool `mapstructure:"backup_pre_save" json:"backup_pre_save"`
+	// BackupSettleSeconds is how long the save files must stay unchanged after a pre-save
+	BackupSettleSeconds int `mapstructure:"backup_settle_seconds" json:"backup_settle_seconds"`
+	// BackupSettleTimeout is the maximum number of seconds to wait for the save files to settle
+	BackupSettleTimeout int `mapstructure:"backup_settle_timeout" json:"backup_settle_timeout"`
+	// BackupTargets names the backup targets to upload to, all targets when empty
+	BackupTargets []string `mapstructure:"backup_targets" json:"backup_targets"`
+	// BackupVerifyInterval is how often in seconds local backups are re-read and verified, 0 disables
+	BackupVerifyInterval int `mapstructure:"backup_verify_interval" json:"backup_verify_interval"`
+	// BackupFormat is zip for a full archive per backup or chunks for the deduplicated chunk store
+	BackupFormat string `mapstructure:"backup_format" json:"backup_format"`
+	// BackupRetention replaces backup_keep_days with a grandfather-father-son policy when set
+	BackupRetention BackupRetention `mapstructure:"backup_retention" json:"backup_retention"`
+	// IngestToken lets pst-agent push saves of this server, pushing is disabled when empty
+	IngestToken string `mapstructure:"ingest_token" json:"-"`
+	// S3 holds the endpoint and credentials of an s3:// path
+	S3 SaveS3 `mapstructure:"s3" json:"s3"`
+}
+
+// SaveS3 configures an s3:// save path. Endpoint and region override the query of the
+// path, without access_key the credentials come from the AWS_* or MINIO_* environment.
+type SaveS3 struct {
+	Endpoint  string `mapstructure:"endpoint" json:"endpoint"`
+	Region    string `mapstructure:"region" json:"region"`
+	AccessKey string `mapstructure:"access_key" json:"access_key"`
+	SecretKey string `mapstructure:"secret_key" json:"-"`
+}
+
+// BackupEncryption encrypts backup archives with a passphrase or a key file holding
+// 32 bytes, raw, hex or base64 encoded. Leave both empty to store backups unencrypted.
+type BackupEncryption struct {
+	Passphrase string `mapstructure:"passphrase" json:"-"`
+	KeyFile    string `mapstructure:"key_file" json:"key_file"`
+}
+
+// BackupRetention keeps every backup of the last KeepAllHours hours, then the first
+// backup of each day, week and month for the given number of periods
+type BackupRetention struct {
+	KeepAllHours int `mapstructure:"keep_all_hours" json:"keep_all_hours"`
+	Daily        int `mapstructure:"daily" json:"daily"`
+	Weekly       int `mapstructure:"weekly" json:"weekly"`
+	Monthly      int `mapstructure:"monthly" json:"monthly"`
+}
+
+// Enabled reports whether any tier of the policy is set
+func (r BackupRetention) Enabled() bool {
+	return r.KeepAllHours > 0 || r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0
+}
+
+// BackupTarget is a remote (or secondary local) location backups are copied to
+type BackupTarget struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Type is one of s3, sftp, webdav, local
+	Type string `mapstructure:"type" json:"type"`
+	// Path is the directory (or object prefix for s3) backups are stored under
+	Path string `mapstructure:"path" json:"path"`
+	// KeepDays overrides save.backup_keep_days for this target
+	KeepDays int `mapstructure:"keep_days" json:"keep_days"`
+
+	// s3
+	Endpoint  string `mapstructure:"endpoint" json:"endpoint"`
+	Bucket    string `mapstructure:"bucket" json:"bucket"`
+	Region    string `mapstructure:"region" json:"region"`
+	AccessKey string `mapstructure:"access_key" json:"access_key"`
+	SecretKey string `mapstructure:"secret_key" json:"-"`
+	UseSSL    bool   `mapstructure:"use_ssl" json:"use_ssl"`
+
+	// sftp (address is host:port) and webdav (address is the server url)
+	Address               string `mapstructure:"address" json:"address"`
+	Username              string `mapstructure:"username" json:"username"`
+	Password              string `mapstructure:"password" json:"-"`
+	PrivateKey            string `mapstructure:"private_key" json:"-"`
+	KnownHosts            string `mapstructure:"known_hosts" json:"known_hosts"`
+	InsecureIgnoreHostKey bool   `mapstructure:"insecure_ignore_host_key" json:"insecure_ignore_host_key"`
 }
 
 type Config struct {
@@ -62,16 +140,14 @@ type Config struct {
 		Password string `mapstructure:"password" json:"password"`
 		Timeout  int    `mapstructure:"timeout" json:"timeout"`
 	} `mapstructure:"rest"`
-	Save struct {
-		Path           string `mapstructure:"path" json:"path"`
-		DecodePath     string `mapstructure:"decode_path" json:"decode_path"`
-		SyncInterval   int    `mapstructure:"sync_interval" json:"sync_interval"`
-		BackupInterval int    `mapstructure:"backup_interval" json:"backup_interval"`
-		BackupKeepDays int    `mapstructure:"backup_keep_days" json:"backup_keep_days"`
-	} `mapstructure:"save"`
+	Save   Save `mapstructure:"save"`
 	Manage struct {
 		KickNonWhitelist bool `mapstructure:"kick_non_whitelist"`
 	}
+	Backup struct {
+		Targets    []BackupTarget   `mapstructure:"targets"`
+		Encryption BackupEncryption `mapstructure:"encryption"`
+	} `mapstructure:"backup"`
 	// Multi-server configuration
 	Servers []Server `mapstructure:"servers"`
 }
@@ -108,8 +184,16 @@ func Init(cfgFile string, conf *Config) {
 	viper.SetDefault("rest.timeout", 5)
 
 	viper.SetDefault("save.sync_interval", 600)
+	viper.SetDefault("save.decode_timeout", 600)
+	viper.SetDefault("save.decode_memory_limit", 0)
+	viper.SetDefault("save.decode_concurrency", 1)
 	viper.SetDefault("save.backup_interval", 14400)
 	viper.SetDefault("save.backup_keep_days", 7)
+	viper.SetDefault("save.backup_pre_save", false)
+	viper.SetDefault("save.backup_settle_seconds", 5)
+	viper.SetDefault("save.backup_settle_timeout", 60)
+	viper.SetDefault("save.backup_format", "zip")
+	viper.SetDefault("save.backup_verify_interval", 86400)
 
 	viper.SetEnvPrefix("")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "__"))
@@ -156,6 +240,38 @@ func GetServer(serverId string) (*Server, bool) {
 	return nil, false
 }
 
+// GetBackupTargets returns the backup targets a server uploads to
+func GetBackupTargets(server *Server) []BackupTarget {
+	if globalConfig == nil {
+		return nil
+	}
+	if len(server.Save.BackupTargets) == 0 {
+		return globalConfig.Backup.Targets
+	}
+	var targets []BackupTarget
+	for _, target := range globalConfig.Backup.Targets {
+		for _, name := range server.Save.BackupTargets {
+			if target.Name == name {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// GetBackupTarget returns a backup target by name
+func GetBackupTarget(name string) (*BackupTarget, bool) {
+	if globalConfig == nil {
+		return nil, false
+	}
+	for _, target := range globalConfig.Backup.Targets {
+		if target.Name == name {
+			return &target, true
+		}
+	}
+	return nil, false
+}
+
 // GetEnabledServers returns all enabled servers
 func GetEnabledServers() []Server {
 	if globalConfig == nil {
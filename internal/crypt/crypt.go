@@ -0,0 +1,361 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted data starts with a header followed by AES-256-GCM sealed segments of
+// SegmentSize bytes. Every file gets its own key derived from the master key and a
+// random salt, and each segment nonce holds its index and a flag for the last
+// segment, so reordered, dropped or truncated segments fail to open.
+//
+//	magic "PSTENC" | version | kdf | kdf salt (16) | file salt (16) | segment size (4) | key check (16)
+const (
+	SegmentSize = 64 << 10
+
+	version    = 1
+	kdfScrypt  = 1
+	kdfRaw     = 2
+	saltSize   = 16
+	checkSize  = 16
+	headerSize = 6 + 1 + 1 + saltSize + saltSize + 4 + checkSize
+)
+
+var magic = []byte("PSTENC")
+
+var (
+	ErrWrongKey     = errors.New("wrong backup encryption key")
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	ErrCorrupt      = errors.New("encrypted data is corrupt or was tampered with")
+	// ErrKeyMismatch is a wrong key of the other kind, a passphrase instead of a key file or the reverse
+	ErrKeyMismatch = fmt.Errorf("%w, data was encrypted with the other kind of key", ErrWrongKey)
+)
+
+// Key is a passphrase or a 32 byte key loaded from a key file
+type Key struct {
+	kdf        byte
+	passphrase []byte
+	raw        []byte
+
+	mu      sync.Mutex
+	salt    []byte
+	derived map[string][]byte
+}
+
+// NewPassphraseKey returns a key derived from passphrase with scrypt
+func NewPassphraseKey(passphrase string) *Key {
+	return &Key{kdf: kdfScrypt, passphrase: []byte(passphrase), derived: make(map[string][]byte)}
+}
+
+// LoadKeyFile reads a 32 byte key stored raw, hex or base64 encoded,
+// e.g. created with `openssl rand -hex 32 > backup.key`
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := data
+	if len(raw) != 32 {
+		text := strings.TrimSpace(string(data))
+		if raw, err = hex.DecodeString(text); err != nil || len(raw) != 32 {
+			if raw, err = base64.StdEncoding.DecodeString(text); err != nil || len(raw) != 32 {
+				return nil, fmt.Errorf("key file %s must hold 32 bytes, raw, hex or base64 encoded", path)
+			}
+		}
+	}
+	return &Key{kdf: kdfRaw, raw: raw, derived: make(map[string][]byte)}, nil
+}
+
+// master returns the master key for the kdf salt. Scrypt is slow on purpose,
+// so results are cached and one salt is reused for everything this key encrypts.
+func (k *Key) master(kdfSalt []byte) ([]byte, error) {
+	if k.kdf == kdfRaw {
+		return k.raw, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if master, ok := k.derived[string(kdfSalt)]; ok {
+		return master, nil
+	}
+	master, err := scrypt.Key(k.passphrase, kdfSalt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.derived[string(kdfSalt)] = master
+	return master, nil
+}
+
+func (k *Key) kdfSalt() ([]byte, error) {
+	if k.kdf == kdfRaw {
+		return make([]byte, saltSize), nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.salt == nil {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		k.salt = salt
+	}
+	return k.salt, nil
+}
+
+func (k *Key) fileCipher(kdfSalt, fileSalt []byte) (cipher.AEAD, []byte, error) {
+	master, err := k.master(kdfSalt)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, master, fileSalt, []byte("pst backup")), fileKey); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(sha256.New, fileKey)
+	mac.Write([]byte("pst backup key check"))
+	return aead, mac.Sum(nil)[:checkSize], nil
+}
+
+func segmentNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// IsEncrypted reports whether data starts with an encryption header
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// Encrypt returns a writer encrypting to w. Close must be called to write the last segment.
+func Encrypt(w io.Writer, key *Key) (io.WriteCloser, error) {
+	kdfSalt, err := key.kdfSalt()
+	if err != nil {
+		return nil, err
+	}
+	fileSalt := make([]byte, saltSize)
+	if _, err = rand.Read(fileSalt); err != nil {
+		return nil, err
+	}
+	aead, check, err := key.fileCipher(kdfSalt, fileSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, version, key.kdf)
+	header = append(header, kdfSalt...)
+	header = append(header, fileSalt...)
+	header = binary.BigEndian.AppendUint32(header, SegmentSize)
+	header = append(header, check...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, header: header, buf: make([]byte, 0, SegmentSize)}, nil
+}
+
+func (e *writer) seal(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.index, last), e.buf, e.header)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypter")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// a full segment is only sealed once more data arrives, so the last one can be flagged
+		if len(e.buf) == SegmentSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(e.buf[len(e.buf):SegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (e *writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	segment []byte
+	plain   []byte
+	index   uint64
+	done    bool
+}
+
+// Decrypt returns a reader decrypting r. A wrong key fails before any data is returned
+// with ErrWrongKey, tampered data fails with ErrCorrupt.
+func Decrypt(r io.Reader, key *Key) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return nil, ErrNotEncrypted
+	}
+	if header[6] != version {
+		return nil, fmt.Errorf("unsupported encryption version %d", header[6])
+	}
+	if header[7] != key.kdf {
+		return nil, ErrKeyMismatch
+	}
+	kdfSalt := header[8 : 8+saltSize]
+	fileSalt := header[8+saltSize : 8+2*saltSize]
+	segmentSize := binary.BigEndian.Uint32(header[8+2*saltSize:])
+	if segmentSize == 0 || segmentSize > 16<<20 {
+		return nil, ErrCorrupt
+	}
+	aead, check, err := key.fileCipher(kdfSalt, fileSalt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, header[headerSize-checkSize:]) {
+		return nil, ErrWrongKey
+	}
+	return &reader{
+		r:       bufio.NewReader(r),
+		aead:    aead,
+		header:  header,
+		segment: make([]byte, int(segmentSize)+aead.Overhead()),
+	}, nil
+}
+
+func (d *reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.segment)
+		last := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err = d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+		plain, err := d.aead.Open(d.segment[:0], segmentNonce(d.index, last), d.segment[:n], d.header)
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		d.index++
+		d.plain = plain
+		d.done = last
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// EncryptFile encrypts src into dst, replacing dst atomically
+func EncryptFile(src, dst string, key *Key) error {
+	return transformFile(src, dst, func(r io.Reader, w io.Writer) error {
+		ew, err := Encrypt(w, key)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(ew, r); err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+}
+
+// DecryptFile decrypts src into dst, replacing dst atomically
+func DecryptFile(src, dst string, key *Key) error {
+	return transformFile(src, dst, func(r io.Reader, w io.Writer) error {
+		dr, err := Decrypt(r, key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, dr)
+		return err
+	})
+}
+
+func transformFile(src, dst string, transform func(io.Reader, io.Writer) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tempFile := filepath.Join(filepath.Dir(dst), ".tmp-"+uuid.New().String())
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	if err = transform(in, out); err != nil {
+		out.Close()
+		os.Remove(tempFile)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err = os.Rename(tempFile, dst); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
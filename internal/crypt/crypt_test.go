@@ -0,0 +1,220 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encrypt(t *testing.T, key *Key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := Encrypt(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key *Key, data []byte) ([]byte, error) {
+	r, err := Decrypt(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeKeyFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(randomBytes(t, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// segmentOffset is where segment i starts in encrypted data
+func segmentOffset(i int) int {
+	return headerSize + i*(SegmentSize+16)
+}
+
+func TestRoundTrip(t *testing.T) {
+	keyFile, err := LoadKeyFile(writeKeyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*Key{
+		"passphrase": NewPassphraseKey("correct horse battery staple"),
+		"key file":   keyFile,
+	}
+	sizes := []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 2 * SegmentSize, 3*SegmentSize + 7}
+	for name, key := range keys {
+		for _, size := range sizes {
+			plain := randomBytes(t, size)
+			data := encrypt(t, key, plain)
+			if !IsEncrypted(data) {
+				t.Fatalf("%s, %d bytes: missing header", name, size)
+			}
+			got, err := decrypt(key, data)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", name, size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("%s, %d bytes: decrypted data differs", name, size)
+			}
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	keyFile, err := LoadKeyFile(writeKeyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyFile, err := LoadKeyFile(writeKeyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := NewPassphraseKey("correct horse battery staple")
+	plain := randomBytes(t, SegmentSize+1)
+
+	tests := []struct {
+		name    string
+		encrypt *Key
+		decrypt *Key
+		want    error
+	}{
+		{"wrong passphrase", passphrase, NewPassphraseKey("Correct horse battery staple"), ErrWrongKey},
+		{"wrong key file", keyFile, otherKeyFile, ErrWrongKey},
+		{"key file for passphrase", passphrase, keyFile, ErrKeyMismatch},
+		{"passphrase for key file", keyFile, passphrase, ErrKeyMismatch},
+	}
+	for _, tt := range tests {
+		data := encrypt(t, tt.encrypt, plain)
+		got, err := decrypt(tt.decrypt, data)
+		if !errors.Is(err, tt.want) || !errors.Is(err, ErrWrongKey) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+		if got != nil {
+			t.Errorf("%s: returned data", tt.name)
+		}
+	}
+}
+
+func TestNotEncrypted(t *testing.T) {
+	key := NewPassphraseKey("secret")
+	for _, data := range [][]byte{nil, []byte("PK\x03\x04 a plain zip"), bytes.Repeat([]byte{0}, headerSize)} {
+		if _, err := Decrypt(bytes.NewReader(data), key); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("%q: got error %v, want ErrNotEncrypted", data, err)
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	key, err := LoadKeyFile(writeKeyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := randomBytes(t, 3*SegmentSize+100)
+	data := encrypt(t, key, plain)
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+	}{
+		{"truncated last segment", func(data []byte) []byte {
+			return data[:len(data)-10]
+		}},
+		{"dropped last segment", func(data []byte) []byte {
+			return data[:segmentOffset(3)]
+		}},
+		{"segment boundary cut", func(data []byte) []byte {
+			return data[:segmentOffset(2)]
+		}},
+		{"reordered segments", func(data []byte) []byte {
+			out := append([]byte{}, data[:segmentOffset(0)]...)
+			out = append(out, data[segmentOffset(1):segmentOffset(2)]...)
+			out = append(out, data[segmentOffset(0):segmentOffset(1)]...)
+			return append(out, data[segmentOffset(2):]...)
+		}},
+		{"flipped bit in segment", func(data []byte) []byte {
+			data[segmentOffset(1)+42] ^= 1
+			return data
+		}},
+		{"flipped bit in tag", func(data []byte) []byte {
+			data[len(data)-1] ^= 0x80
+			return data
+		}},
+		{"appended data", func(data []byte) []byte {
+			return append(data, 0)
+		}},
+	}
+	for _, tt := range tests {
+		tampered := tt.tamper(append([]byte{}, data...))
+		if _, err := decrypt(key, tampered); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got error %v, want ErrCorrupt", tt.name, err)
+		}
+	}
+
+	// the header is authenticated with every segment
+	tampered := append([]byte{}, data...)
+	tampered[headerSize-checkSize-1] ^= 1
+	if _, err := decrypt(key, tampered); err == nil {
+		t.Error("changed segment size: decrypted anyway")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	key := NewPassphraseKey("secret")
+	dir := t.TempDir()
+	plain := randomBytes(t, SegmentSize+1)
+	src := filepath.Join(dir, "backup.zip")
+	if err := os.WriteFile(src, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(src, src+".enc", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFile(src+".enc", filepath.Join(dir, "out.zip"), key); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "out.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decrypted file differs")
+	}
+
+	// a failed decryption leaves no partial output behind
+	if err = DecryptFile(src+".enc", filepath.Join(dir, "wrong.zip"), NewPassphraseKey("guess")); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got error %v, want ErrWrongKey", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected only the zip, the encrypted and the decrypted file, found %d entries", len(entries))
+	}
+}
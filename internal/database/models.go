@@ -115,11 +115,52 @@ type Item struct {
 	StackCount int32  `json:"StackCount"`
 }
 
+const (
+	BackupTriggerScheduled   = "scheduled"
+	BackupTriggerManual      = "manual"
+	BackupTriggerPreRestore  = "pre-restore"
+	BackupTriggerPreShutdown = "pre-shutdown"
+)
+
+const (
+	BackupFormatZip    = "zip"
+	BackupFormatChunks = "chunks"
+)
+
+const (
+	BackupVerifyOk     = "ok"
+	BackupVerifyFailed = "failed"
+)
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
 type Backup struct {
 	ServerId string    `json:"server_id"`
 	BackupId string    `json:"backup_id"`
 	SaveTime time.Time `json:"save_time"`
 	Path     string    `json:"path"`
+	PreSaved bool      `json:"pre_saved"`
+	// Targets lists the backup targets holding a copy of the archive
+	Targets []string `json:"targets"`
+	Label   string   `json:"label"`
+	Note    string   `json:"note"`
+	// Pinned backups are never removed by retention
+	Pinned  bool   `json:"pinned"`
+	Size    int64  `json:"size"`
+	Sha256  string `json:"sha256"`
+	Trigger string `json:"trigger"` // scheduled, manual, pre-restore, pre-shutdown
+	Format  string `json:"format"`  // zip, or chunks when stored in the chunk store
+	// Encrypted archives and chunks need the backup encryption key to be read
+	Encrypted bool `json:"encrypted"`
+	// Files holds the checksum of every saved file at backup time
+	Files        []BackupFile `json:"files"`
+	VerifyStatus string       `json:"verify_status"` // ok or failed, empty until verified
+	VerifiedAt   time.Time    `json:"verified_at"`
+	VerifyError  string       `json:"verify_error"`
 }
 
 // ServerInfo represents stored server configuration and status
@@ -132,3 +173,15 @@ type ServerInfo struct {
 	LastCheck   time.Time              `json:"last_check"`
 	Config      map[string]interface{} `json:"config"`
 }
+
+// TaskState is the persisted state of a scheduled task
+type TaskState struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+	// Interval in seconds replaces the configured interval when set
+	Interval     int       `json:"interval"`
+	LastRun      time.Time `json:"last_run"`
+	LastResult   string    `json:"last_result"` // success, failed, unchanged, skipped
+	LastError    string    `json:"last_error"`
+	LastDuration float64   `json:"last_duration"`
+}
@@ -0,0 +1,244 @@
+package source
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+// agentSignatureWindow is how far the timestamp of a signed request may be off
+const agentSignatureWindow = 5 * time.Minute
+
+// AgentBodyHashHeader carries the hex SHA-256 of the request body, it is part of the
+// signature and the body is checked against it while it is read
+const AgentBodyHashHeader = "X-Pst-Body-Sha256"
+
+// emptyBodySha256 is the SHA-256 of an empty body
+const emptyBodySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var ErrAgentUnauthorized = errors.New("missing or invalid agent token")
+
+var errAgentBodyMismatch = errors.New("request body does not match its signed checksum")
+
+var (
+	seenSignaturesMu sync.Mutex
+	// seenSignatures keeps the signatures accepted within agentSignatureWindow to reject replays
+	seenSignatures = make(map[string]time.Time)
+)
+
+// AgentAuth is how PST authenticates to a pst-agent and verifies its certificate
+type AgentAuth struct {
+	Token string
+	// Scheme is hmac to sign every request with Token, or bearer to send Token itself
+	Scheme string
+	// CAFile is a PEM bundle trusted for the agent certificate, e.g. a self-signed one
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// Client returns the http client for requests to the agent
+func (a AgentAuth) Client() (*http.Client, error) {
+	if a.CAFile == "" && !a.InsecureSkipVerify {
+		return http.DefaultClient, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+	if a.CAFile != "" {
+		pem, err := os.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, errors.New("error reading agent ca: " + err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", a.CAFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// Sign adds the Authorization header to a request for the agent. Requests with a body
+// must set AgentBodyHashHeader first, others are signed as having an empty body.
+func (a AgentAuth) Sign(req *http.Request) {
+	if a.Token == "" {
+		return
+	}
+	if a.Scheme == "bearer" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		return
+	}
+	bodyHash := req.Header.Get(AgentBodyHashHeader)
+	if bodyHash == "" {
+		bodyHash = emptyBodySha256
+		req.Header.Set(AgentBodyHashHeader, bodyHash)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	nonceHex := hex.EncodeToString(nonce)
+	signature := agentSignature(a.Token, req.Method, req.URL.Path, timestamp, nonceHex, bodyHash)
+	req.Header.Set("Authorization", "Bearer "+timestamp+"."+nonceHex+"."+signature)
+}
+
+// agentSignature is the hex HMAC-SHA256 of method, path, timestamp, nonce and body
+// checksum keyed by the token
+func agentSignature(token, method, path, timestamp, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + strings.ToLower(bodyHash)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAgentRequest accepts the token itself or a signature made with it no older than
+// agentSignatureWindow as bearer token. Every signature is accepted once, and the body
+// of a signed request fails to read to the end when it doesn't match its checksum.
+func VerifyAgentRequest(r *http.Request, token string) error {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return ErrAgentUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+		return nil
+	}
+	parts := strings.Split(bearer, ".")
+	if len(parts) != 3 {
+		return ErrAgentUnauthorized
+	}
+	timestamp, nonce, signature := parts[0], parts[1], parts[2]
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrAgentUnauthorized
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > agentSignatureWindow || skew < -agentSignatureWindow {
+		return fmt.Errorf("agent signature expired, check the clocks: %w", ErrAgentUnauthorized)
+	}
+	bodyHash := r.Header.Get(AgentBodyHashHeader)
+	expected := agentSignature(token, r.Method, r.URL.Path, timestamp, nonce, bodyHash)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrAgentUnauthorized
+	}
+	if !markSignatureSeen(signature) {
+		return fmt.Errorf("agent signature already used: %w", ErrAgentUnauthorized)
+	}
+	if r.Body != nil {
+		r.Body = &bodyVerifier{ReadCloser: r.Body, hash: sha256.New(), expected: strings.ToLower(bodyHash)}
+	}
+	return nil
+}
+
+// markSignatureSeen records a signature, false when it was seen before
+func markSignatureSeen(signature string) bool {
+	seenSignaturesMu.Lock()
+	defer seenSignaturesMu.Unlock()
+	now := time.Now()
+	for seen, at := range seenSignatures {
+		// twice the window covers timestamps from the future as well
+		if now.Sub(at) > 2*agentSignatureWindow {
+			delete(seenSignatures, seen)
+		}
+	}
+	if _, ok := seenSignatures[signature]; ok {
+		return false
+	}
+	seenSignatures[signature] = now
+	return true
+}
+
+// bodyVerifier hashes a request body while it is read and returns an error instead
+// of io.EOF when it doesn't match the signed checksum
+type bodyVerifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (b *bodyVerifier) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.expected {
+		return n, errAgentBodyMismatch
+	}
+	return n, err
+}
+
+// AgentFile is a save file listed by pst-agent, Name is slash separated below the save directory
+type AgentFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Sha256  string    `json:"sha256"`
+}
+
+// AgentManifest lists the save files of pst-agent, ETag is a hash of their content
+type AgentManifest struct {
+	ETag  string      `json:"etag"`
+	Files []AgentFile `json:"files"`
+}
+
+var (
+	manifestHashMu sync.Mutex
+	// manifestHashes keeps the last hash of every file, reused while size and mtime match
+	manifestHashes = make(map[string]AgentFile)
+)
+
+// BuildAgentManifest hashes the .sav files of savDir, only files changed since the last
+// build are read again
+func BuildAgentManifest(savDir string) (AgentManifest, error) {
+	names, err := system.ListSavFiles(savDir)
+	if err != nil {
+		return AgentManifest{}, err
+	}
+	manifest := AgentManifest{Files: make([]AgentFile, 0, len(names))}
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		file := filepath.Join(savDir, filepath.FromSlash(name))
+		info, err := os.Stat(file)
+		if err != nil {
+			return AgentManifest{}, err
+		}
+		manifestHashMu.Lock()
+		entry, ok := manifestHashes[file]
+		manifestHashMu.Unlock()
+		if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+			entry = AgentFile{Name: name, ModTime: info.ModTime()}
+			if entry.Size, entry.Sha256, err = system.Sha256File(file); err != nil {
+				return AgentManifest{}, err
+			}
+			manifestHashMu.Lock()
+			manifestHashes[file] = entry
+			manifestHashMu.Unlock()
+		}
+		manifest.Files = append(manifest.Files, entry)
+		lines = append(lines, name+" "+entry.Sha256)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	manifest.ETag = hex.EncodeToString(sum[:])
+	return manifest, nil
+}
+
+// MatchETag reports whether an If-None-Match header matches etag
+func MatchETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), "\"")
+		if candidate == "*" || (candidate != "" && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,24 +1,80 @@
 package source
 
 import (
-	"bytes"
+	"archive/tar"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/google/uuid"
-	"github.com/zaigie/palworld-server-tool/internal/system"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/google/uuid"
 	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
 )
 
+const defaultVolumeImage = "busybox:latest"
+
+func init() {
+	Register("docker", func(address string) (Driver, error) {
+		return ParseDockerDriver(address)
+	})
+}
+
+// DockerDriver reads the save through the docker archive api, the container needs no shell.
+//
+//	docker://containerID(Name):remotePath
+//	docker://service=palworld:remotePath          compose service, or any label=value list
+//	docker://volume/volumeName:remotePath?image=  remotePath inside the named volume
+type DockerDriver struct {
+	// ContainerId may also be comma separated label=value pairs, service and project
+	// standing for the compose labels. The newest running container matching them is used.
+	ContainerId string
+	// Volume is read through a container mounting it, or a helper container created from Image
+	Volume string
+	Image  string
+	Path   string
+}
+
+// ParseDockerDriver parses a docker save.path with its optional image query parameter
+func ParseDockerDriver(address string) (*DockerDriver, error) {
+	var query url.Values
+	if i := strings.LastIndex(address, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(address[i+1:]); err != nil {
+			return nil, errors.New("error parsing docker address: " + err.Error())
+		}
+		address = address[:i]
+	}
+	containerID, remotePath, err := ParseDockerAddress(address)
+	if err != nil {
+		return nil, errors.New("error parsing docker address: " + err.Error())
+	}
+	driver := &DockerDriver{ContainerId: containerID, Path: remotePath, Image: query.Get("image")}
+	if volume, ok := strings.CutPrefix(containerID, "volume/"); ok {
+		if volume == "" {
+			return nil, errors.New("invalid docker address, eg: docker://volume/palworld-data:/Pal/Saved")
+		}
+		driver.ContainerId, driver.Volume = "", volume
+	}
+	if driver.Image == "" {
+		driver.Image = defaultVolumeImage
+	}
+	return driver, nil
+}
+
 func getDockerClient() (*client.Client, error) {
 	dockerAPIVersion := os.Getenv("DOCKER_API_VERSION")
 	if dockerAPIVersion == "" {
@@ -28,105 +84,418 @@ func getDockerClient() (*client.Client, error) {
 	}
 }
 
-func CopyFromContainer(containerID, remotePath, way string) (string, error) {
-	logger.Infof("copying savDir from %s\n", remotePath)
+// dockerSession is a docker connection to the resolved container
+type dockerSession struct {
+	cli       *client.Client
+	container string
+	path      string
+	cleanup   func()
+}
 
+func (d *DockerDriver) connect(ctx context.Context) (*dockerSession, error) {
 	cli, err := getDockerClient()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	s := &dockerSession{cli: cli, container: d.ContainerId, path: d.Path}
+	switch {
+	case d.Volume != "":
+		var mountPoint string
+		s.container, mountPoint, s.cleanup, err = volumeContainer(ctx, cli, d.Volume, d.Image)
+		s.path = path.Join(mountPoint, d.Path)
+	case strings.Contains(d.ContainerId, "="):
+		s.container, err = resolveContainer(ctx, cli, d.ContainerId)
+	}
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+	s.path = path.Clean(s.path)
+	return s, nil
+}
+
+func (s *dockerSession) Close() {
+	if s.cleanup != nil {
+		s.cleanup()
 	}
-	defer cli.Close()
+	s.cli.Close()
+}
 
-	// 取得Level.sav所在目录
-	findCmd := []string{"sh", "-c", fmt.Sprintf("find %s -maxdepth 4 -path '*/backup/*' -prune -o -name 'Level.sav' -print | xargs dirname", remotePath)}
-	savDir, err := execCommand(containerID, findCmd, cli)
+// resolveContainer returns the newest running container carrying all labels of selector
+func resolveContainer(ctx context.Context, cli *client.Client, selector string) (string, error) {
+	args := filters.NewArgs(filters.Arg("status", "running"))
+	for _, label := range strings.Split(selector, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(label), "=")
+		if key == "service" || key == "project" {
+			key = "com.docker.compose." + key
+		}
+		args.Add("label", key+"="+value)
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: args})
 	if err != nil {
 		return "", err
 	}
-	savDir = strings.TrimSpace(savDir)
-	if savDir == "" {
-		return "", errors.New("directory containing Level.sav not found in container")
+	if len(containers) == 0 {
+		return "", fmt.Errorf("no running container matches %s", selector)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created > containers[j].Created
+	})
+	if len(containers) > 1 {
+		logger.Warnf("%d containers match %s, using the newest %s\n", len(containers), selector, containers[0].Names)
 	}
+	return containers[0].ID, nil
+}
 
-	// 压缩
-	tarCmd := []string{"sh", "-c", fmt.Sprintf("cd \"%s\" && tar czf - ./*.sav ./Players/*.sav", savDir)}
-	tarReader, err := execCommandStream(containerID, tarCmd, cli)
+// volumeContainer returns a container mounting the volume and where it is mounted.
+// When no container uses the volume a stopped helper container is created for the
+// archive api, cleanup removes it again.
+func volumeContainer(ctx context.Context, cli *client.Client, volume, image string) (string, string, func(), error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("volume", volume)),
+	})
 	if err != nil {
-		return "", err
+		return "", "", nil, err
+	}
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeVolume && m.Name == volume {
+				return c.ID, m.Destination, nil, nil
+			}
+		}
 	}
 
-	// 创建临时目录
-	id := uuid.New().String()
-	tempDir := filepath.Join(os.TempDir(), "palworldsav-docker-"+way+"-"+id)
-	err = os.MkdirAll(tempDir, os.ModePerm)
+	// creating a container with an unknown volume would create the volume
+	if _, err = cli.VolumeInspect(ctx, volume); err != nil {
+		return "", "", nil, err
+	}
+	if _, _, err = cli.ImageInspectWithRaw(ctx, image); client.IsErrNotFound(err) {
+		logger.Infof("pulling %s to read volume %s\n", image, volume)
+		progress, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return "", "", nil, err
+		}
+		_, err = io.Copy(io.Discard, progress)
+		progress.Close()
+		if err != nil {
+			return "", "", nil, err
+		}
+	} else if err != nil {
+		return "", "", nil, err
+	}
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  image,
+		Cmd:    []string{"true"},
+		Labels: map[string]string{"pst.volume": volume},
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: volume, Target: "/volume"}},
+	}, nil, nil, "")
 	if err != nil {
-		return "", err
+		return "", "", nil, err
+	}
+	cleanup := func() {
+		if err := cli.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true}); err != nil {
+			logger.Warnf("Failed to remove helper container %s: %v\n", created.ID, err)
+		}
 	}
+	return created.ID, "/volume", cleanup, nil
+}
+
+// root is the directory whose archive is walked
+func (s *dockerSession) root() string {
+	if path.Base(s.path) == "Level.sav" {
+		return path.Dir(s.path)
+	}
+	return s.path
+}
 
-	// 解压文件
-	err = system.UnTarGzDir(tarReader, tempDir)
+// savArchive is what a walk of the archive found
+type savArchive struct {
+	dir      string // directory of Level.sav, relative to root
+	names    []string
+	uid, gid int // owner of Level.sav
+}
+
+// walkSavArchive streams the archive of root and calls onFile for every .sav file that
+// may belong to the save, named relative to root. Backup directories are skipped and the
+// shallowest Level.sav up to 4 levels down is taken as the save.
+func (s *dockerSession) walkSavArchive(ctx context.Context, onFile func(name string, header *tar.Header, r io.Reader) error) (savArchive, error) {
+	reader, _, err := s.cli.CopyFromContainer(ctx, s.container, s.root())
 	if err != nil {
-		return "", err
+		return savArchive{}, err
 	}
+	defer reader.Close()
 
-	levelFilePath := filepath.Join(tempDir, "Level.sav")
-	return levelFilePath, nil
+	var found savArchive
+	var names []string
+	depth := -1
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return savArchive{}, err
+		}
+		// entries are named after the base of root
+		_, name, ok := strings.Cut(header.Name, "/")
+		if !ok || header.Typeflag != tar.TypeReg || !strings.HasSuffix(name, ".sav") {
+			continue
+		}
+		dir := path.Dir(name)
+		dirDepth := 0
+		if dir != "." {
+			dirDepth = strings.Count(dir, "/") + 1
+		}
+		if dirDepth > 4 || strings.Contains("/"+dir+"/", "/backup/") {
+			continue
+		}
+		if path.Base(name) == "Level.sav" && dirDepth < 4 && (depth < 0 || dirDepth < depth) {
+			found = savArchive{dir: dir, uid: header.Uid, gid: header.Gid}
+			depth = dirDepth
+		}
+		names = append(names, name)
+		if onFile != nil {
+			if err = onFile(name, header, tr); err != nil {
+				return savArchive{}, err
+			}
+		}
+	}
+	if depth < 0 {
+		return savArchive{}, errors.New("directory containing Level.sav not found in container")
+	}
+	for _, name := range names {
+		if rel, ok := savDirEntry(found.dir, name); ok {
+			found.names = append(found.names, rel)
+		}
+	}
+	return found, nil
 }
 
-func execCommandStream(containerID string, command []string, cli *client.Client) (io.Reader, error) {
+// savDirEntry returns name relative to savDir if it is one of its *.sav or Players/*.sav
+func savDirEntry(savDir, name string) (string, bool) {
+	if savDir != "." {
+		var ok bool
+		if name, ok = strings.CutPrefix(name, savDir+"/"); !ok {
+			return "", false
+		}
+	}
+	dir := path.Dir(name)
+	return name, dir == "." || dir == "Players"
+}
+
+func (d *DockerDriver) Fetch(way string) (string, error) {
+	logger.Infof("copying savDir from %s\n", d.Path)
 	ctx := context.Background()
-	execConfig := types.ExecConfig{
-		Cmd:          command,
-		AttachStdout: true,
-		AttachStderr: true,
+	s, err := d.connect(ctx)
+	if err != nil {
+		return "", err
 	}
-	ir, err := cli.ContainerExecCreate(ctx, containerID, execConfig)
+	defer s.Close()
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-docker-"+way+"-"+uuid.New().String())
+	key := d.layoutKey(s)
+	if cached, ok := dockerLayouts.Load(key); ok {
+		if err = s.copySavDir(ctx, cached.(savArchive), tempDir); err == nil {
+			return filepath.Join(tempDir, "Level.sav"), nil
+		}
+		os.RemoveAll(tempDir)
+		dockerLayouts.Delete(key)
+	}
+
+	// the walk only reads the headers to find the save directory
+	found, err := s.walkSavArchive(ctx, nil)
 	if err != nil {
-		return nil, err
+		return "", errors.New("error copying file from container: " + err.Error())
+	}
+	dockerLayouts.Store(key, found)
+	if err = s.copySavDir(ctx, found, tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", errors.New("error copying file from container: " + err.Error())
+	}
+	return filepath.Join(tempDir, "Level.sav"), nil
+}
+
+// copySavDir copies the top level .sav files of the save directory and Players/*.sav
+// into destDir, each on its own so the backups next to them are not streamed
+func (s *dockerSession) copySavDir(ctx context.Context, layout savArchive, destDir string) error {
+	savDir := path.Join(s.root(), layout.dir)
+	extractor := system.NewExtractor(destDir)
+	if err := os.MkdirAll(filepath.Join(destDir, "Players"), 0755); err != nil {
+		return err
 	}
-	hr, err := cli.ContainerExecAttach(ctx, ir.ID, types.ExecStartCheck{})
+	// entries are named after the base of src, dir is where the wanted files are
+	copyArchive := func(src, dir string) error {
+		reader, _, err := s.cli.CopyFromContainer(ctx, s.container, src)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		tr := tar.NewReader(reader)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg || path.Dir(header.Name) != dir || !strings.HasSuffix(header.Name, ".sav") {
+				continue
+			}
+			if err = extractor.WriteFile(header.Name, tr, header.Size, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range layout.names {
+		if path.Dir(name) != "." {
+			continue
+		}
+		if err := copyArchive(path.Join(savDir, name), "."); err != nil {
+			return err
+		}
+	}
+	err := copyArchive(path.Join(savDir, "Players"), "Players")
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Write copies the .sav files of srcDir into the save directory, keeping the ownership
+// of the existing Level.sav
+func (d *DockerDriver) Write(srcDir string) error {
+	ctx := context.Background()
+	s, err := d.connect(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer s.Close()
 
-	reader, writer := io.Pipe()
+	found, err := s.walkSavArchive(ctx, nil)
+	if err != nil {
+		return err
+	}
+	savDir := path.Join(s.root(), found.dir)
+	logger.Infof("writing savDir to %s:%s\n", s.container, savDir)
 
+	reader, writer := io.Pipe()
 	go func() {
-		defer writer.Close()
-		defer hr.Close()
-		_, err = stdcopy.StdCopy(writer, os.Stderr, hr.Reader)
-		if err != nil {
-			logger.Errorf("Stream to docker failed: %v", err)
-		}
+		writer.CloseWithError(system.TarSavDir(srcDir, writer, false, found.uid, found.gid))
 	}()
+	defer reader.Close()
 
-	return reader, nil
+	return s.cli.CopyToContainer(ctx, s.container, savDir, reader, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
 }
 
-func execCommand(containerID string, command []string, cli *client.Client) (string, error) {
+func (d *DockerDriver) SavDir() (string, error) {
 	ctx := context.Background()
-	execConfig := types.ExecConfig{
-		Cmd:          command,
-		AttachStdout: true,
-		AttachStderr: true,
-	}
-	ir, err := cli.ContainerExecCreate(ctx, containerID, execConfig)
+	s, err := d.connect(ctx)
 	if err != nil {
 		return "", err
 	}
-	hr, err := cli.ContainerExecAttach(ctx, ir.ID, types.ExecStartCheck{})
+	defer s.Close()
+
+	found, err := s.walkSavArchive(ctx, nil)
 	if err != nil {
 		return "", err
 	}
-	defer hr.Close()
+	return path.Join(s.root(), found.dir), nil
+}
+
+// dockerLayouts remembers the save files found by a full walk, keyed by address, so polling
+// and fetching handle them one by one instead of streaming the backups again
+var dockerLayouts sync.Map
 
-	var outBuf bytes.Buffer
-	_, err = stdcopy.StdCopy(&outBuf, os.Stderr, hr.Reader)
+func (d *DockerDriver) layoutKey(s *dockerSession) string {
+	return d.ContainerId + d.Volume + ":" + s.root()
+}
+
+func (d *DockerDriver) Stat() (Stat, error) {
+	ctx := context.Background()
+	s, err := d.connect(ctx)
 	if err != nil {
-		return "", err
+		return Stat{}, err
+	}
+	defer s.Close()
+
+	key := d.layoutKey(s)
+	if cached, ok := dockerLayouts.Load(key); ok {
+		if stat, err := s.statLayout(ctx, cached.(savArchive)); err == nil {
+			return stat, nil
+		}
+		dockerLayouts.Delete(key)
+	}
+
+	headers := make(map[string]*tar.Header)
+	found, err := s.walkSavArchive(ctx, func(name string, header *tar.Header, _ io.Reader) error {
+		headers[name] = header
+		return nil
+	})
+	if err != nil {
+		return Stat{}, err
+	}
+	listing := ""
+	for _, name := range found.names {
+		header := headers[path.Join(found.dir, name)]
+		listing += fmt.Sprintf("./%s %d %d\n", name, header.Size, header.ModTime.Unix())
+	}
+	stat, err := statFromListing(listing)
+	if err == nil {
+		dockerLayouts.Store(key, found)
 	}
+	return stat, err
+}
+
+// statLayout stats the known top level save files and lists Players, new or missing
+// top level files fail so the caller walks again
+func (s *dockerSession) statLayout(ctx context.Context, layout savArchive) (Stat, error) {
+	savDir := path.Join(s.root(), layout.dir)
+	listing := ""
+	for _, name := range layout.names {
+		if path.Dir(name) != "." {
+			continue
+		}
+		info, err := s.cli.ContainerStatPath(ctx, s.container, path.Join(savDir, name))
+		if err != nil {
+			return Stat{}, err
+		}
+		listing += fmt.Sprintf("./%s %d %d\n", name, info.Size, info.Mtime.Unix())
+	}
+
+	reader, _, err := s.cli.CopyFromContainer(ctx, s.container, path.Join(savDir, "Players"))
+	if client.IsErrNotFound(err) {
+		return statFromListing(listing)
+	}
+	if err != nil {
+		return Stat{}, err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Stat{}, err
+		}
+		_, name, _ := strings.Cut(header.Name, "/")
+		if header.Typeflag == tar.TypeReg && path.Dir(name) == "." && strings.HasSuffix(name, ".sav") {
+			listing += fmt.Sprintf("./Players/%s %d %d\n", name, header.Size, header.ModTime.Unix())
+		}
+	}
+	return statFromListing(listing)
+}
 
-	return outBuf.String(), nil
+func (d *DockerDriver) Watch(ctx context.Context, onChange func(Stat)) error {
+	return watchByStat(ctx, d, 30*time.Second, onChange)
 }
 
 func ParseDockerAddress(address string) (containerID, filePath string, err error) {
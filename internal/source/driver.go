@@ -0,0 +1,150 @@
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+)
+
+var (
+	ErrNotSupported = errors.New("operation not supported by this save source")
+	ErrNotModified  = errors.New("save not modified")
+)
+
+// Driver reads and writes the save behind one save.path address
+type Driver interface {
+	// Fetch copies the save files into a new temporary directory and returns
+	// the path of Level.sav inside it. way names the caller for the directory name.
+	Fetch(way string) (string, error)
+	// Write replaces the save files with the .sav files of srcDir
+	Write(srcDir string) error
+	// Stat describes the current save without copying it
+	Stat() (Stat, error)
+	// Watch calls onChange whenever the save changes, until ctx is done
+	Watch(ctx context.Context, onChange func(Stat)) error
+}
+
+// Locator is implemented by drivers that can tell where the save files are
+// written, restores need it to plan which files get replaced
+type Locator interface {
+	SavDir() (string, error)
+}
+
+// ConditionalFetcher is implemented by drivers that can tell an unchanged save
+// before copying it
+type ConditionalFetcher interface {
+	// FetchIfChanged is Fetch returning the version of the copied save as well,
+	// or ErrNotModified while the save still is at version
+	FetchIfChanged(way, version string) (string, string, error)
+}
+
+// Stat describes a save. Checksum changes whenever any save file does.
+type Stat struct {
+	ModTime  time.Time `json:"mod_time"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+}
+
+// Factory creates the driver for an address of its scheme
+type Factory func(address string) (Driver, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes a driver available for addresses starting with scheme://.
+// The "file" scheme also serves addresses without a scheme.
+func Register(scheme string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[scheme] = factory
+}
+
+// Open returns the driver for a save.path address
+func Open(address string) (Driver, error) {
+	scheme := "file"
+	if i := strings.Index(address, "://"); i > 0 {
+		scheme = address[:i]
+	}
+	driversMu.RLock()
+	factory, ok := drivers[scheme]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported save source scheme %s", scheme)
+	}
+	return factory(address)
+}
+
+// watchByStat polls Stat every interval and reports checksum changes
+func watchByStat(ctx context.Context, driver Driver, interval time.Duration, onChange func(Stat)) error {
+	last, err := driver.Stat()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			stat, err := driver.Stat()
+			if err != nil {
+				logger.Warnf("Failed to stat save source: %v\n", err)
+				continue
+			}
+			if stat.Checksum != last.Checksum {
+				last = stat
+				onChange(stat)
+			}
+		}
+	}
+}
+
+// statFromListing builds a Stat from "name size mtime" lines of the save files,
+// with mtime in unix seconds, as printed by stat -c '%n %s %Y'
+func statFromListing(listing string) (Stat, error) {
+	var stat Stat
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(listing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			return Stat{}, fmt.Errorf("invalid save file listing: %s", line)
+		}
+		mtime, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return Stat{}, fmt.Errorf("invalid save file listing: %s", line)
+		}
+		stat.Size += size
+		if modTime := time.Unix(mtime, 0); modTime.After(stat.ModTime) {
+			stat.ModTime = modTime
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if len(lines) == 0 {
+		return Stat{}, errors.New("no save files found")
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	stat.Checksum = hex.EncodeToString(sum[:])
+	return stat, nil
+}
+
+// statListCmd prints "name size mtime" for every save file below savDir
+func statListCmd(savDir string) []string {
+	return []string{"sh", "-c", fmt.Sprintf("cd \"%s\" && for f in ./*.sav ./Players/*.sav; do [ -f \"$f\" ] && stat -c '%%n %%s %%Y' \"$f\"; done; true", savDir)}
+}
@@ -1,33 +1,524 @@
 package source
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/system"
 )
 
-func DownloadFromHttp(url, way string) (string, error) {
-	logger.Infof("downloading sav.zip from %s\n", url)
-	resp, err := http.Get(url)
+func init() {
+	factory := func(address string) (Driver, error) {
+		return ParseHttpAddress(address)
+	}
+	Register("http", factory)
+	Register("https", factory)
+}
+
+// httpCacheMu guards the file caches of agent downloads
+var httpCacheMu sync.Mutex
+
+const (
+	defaultHttpTimeout        = 5 * time.Minute
+	defaultHttpRetries        = 3
+	defaultHttpChecksumHeader = "X-Content-Sha256"
+	// maxHttpBackoff caps the wait between retries
+	maxHttpBackoff = 30 * time.Second
+)
+
+// HttpDriver downloads the save as a zip archive, e.g. from pst-agent,
+// http(s)://[user:password@]host:port/sync?token=...&auth=bearer&ca=...&insecure_skip_verify=true
+type HttpDriver struct {
+	Url     string
+	Options HttpOptions
+}
+
+// HttpOptions are the request settings of a server, taken from the query of its save.path
+type HttpOptions struct {
+	Auth AgentAuth
+	// Username and Password are sent as basic auth, e.g. for a reverse proxy in front of the archive
+	Username string
+	Password string
+	Headers  http.Header
+	// Timeout limits every request including the transfer of its body
+	Timeout time.Duration
+	// Retries is how often a request failing with a network error or 5xx is repeated
+	Retries int
+	// MaxSize is the largest archive or file accepted, 0 for no limit
+	MaxSize int64
+	// ChecksumHeader is the response header with the hex sha256 of the archive,
+	// which is verified before extraction when the server sends it
+	ChecksumHeader string
+}
+
+// ParseHttpAddress takes the request options out of the query of an http(s) save.path,
+// they are never sent as part of the url. Besides the agent credentials these are
+// timeout (seconds), retries, max_size_mb, checksum_header and header=Name:Value,
+// which may be repeated. Basic auth is taken from the user info of the url.
+func ParseHttpAddress(address string) (*HttpDriver, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.New("error parsing http address: " + err.Error())
+	}
+	query := u.Query()
+	options := HttpOptions{
+		Auth: AgentAuth{
+			Token:              query.Get("token"),
+			Scheme:             query.Get("auth"),
+			CAFile:             query.Get("ca"),
+			InsecureSkipVerify: query.Get("insecure_skip_verify") == "true",
+		},
+		Headers:        make(http.Header),
+		Timeout:        defaultHttpTimeout,
+		Retries:        defaultHttpRetries,
+		ChecksumHeader: defaultHttpChecksumHeader,
+	}
+	if options.Auth.Scheme != "" && options.Auth.Scheme != "hmac" && options.Auth.Scheme != "bearer" {
+		return nil, fmt.Errorf("invalid agent auth %s, must be hmac or bearer", options.Auth.Scheme)
+	}
+	if u.User != nil {
+		if options.Auth.Token != "" {
+			return nil, errors.New("basic auth and agent token can't be used together")
+		}
+		options.Username = u.User.Username()
+		options.Password, _ = u.User.Password()
+		u.User = nil
+	}
+	if timeout := query.Get("timeout"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid http timeout %s", timeout)
+		}
+		options.Timeout = time.Duration(seconds) * time.Second
+	}
+	if retries := query.Get("retries"); retries != "" {
+		if options.Retries, err = strconv.Atoi(retries); err != nil || options.Retries < 0 {
+			return nil, fmt.Errorf("invalid http retries %s", retries)
+		}
+	}
+	if maxSize := query.Get("max_size_mb"); maxSize != "" {
+		megabytes, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || megabytes <= 0 {
+			return nil, fmt.Errorf("invalid http max_size_mb %s", maxSize)
+		}
+		options.MaxSize = megabytes << 20
+	}
+	if checksumHeader := query.Get("checksum_header"); checksumHeader != "" {
+		options.ChecksumHeader = checksumHeader
+	}
+	for _, header := range query["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid http header %s, eg: header=X-Api-Key:secret", header)
+		}
+		options.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for _, key := range []string{"token", "auth", "ca", "insecure_skip_verify", "timeout", "retries", "max_size_mb", "checksum_header", "header"} {
+		query.Del(key)
+	}
+	u.RawQuery = query.Encode()
+	return &HttpDriver{Url: u.String(), Options: options}, nil
+}
+
+// client is the agent client limited to the timeout of the server
+func (o HttpOptions) client() (*http.Client, error) {
+	client, err := o.Auth.Client()
+	if err != nil {
+		return nil, err
+	}
+	limited := *client
+	limited.Timeout = o.Timeout
+	return &limited, nil
+}
+
+// do sends the request built by newRequest with headers and credentials, repeating it
+// with exponential backoff on network errors, 5xx and 429. The last response is returned
+// whatever its status, newRequest is called again for every attempt to rewind the body.
+func (o HttpOptions) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	client, err := o.client()
+	if err != nil {
+		return nil, err
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range o.Headers {
+			req.Header[name] = values
+		}
+		if o.Username != "" {
+			req.SetBasicAuth(o.Username, o.Password)
+		}
+		o.Auth.Sign(req)
+		resp, err := client.Do(req)
+		retry := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !retry || attempt >= o.Retries {
+			return resp, err
+		}
+		if err != nil {
+			logger.Warnf("request to %s failed, retrying in %s: %v\n", req.URL.Redacted(), backoff, err)
+		} else {
+			logger.Warnf("request to %s failed, retrying in %s: %s\n", req.URL.Redacted(), backoff, resp.Status)
+			resp.Body.Close()
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxHttpBackoff)
+	}
+}
+
+// copyLimited copies the body of resp to dst, failing once more than MaxSize bytes were read
+func (o HttpOptions) copyLimited(dst io.Writer, resp *http.Response) error {
+	if o.MaxSize <= 0 {
+		_, err := io.Copy(dst, resp.Body)
+		return err
+	}
+	if resp.ContentLength > o.MaxSize {
+		return fmt.Errorf("download of %d bytes exceeds max_size_mb of %d", resp.ContentLength, o.MaxSize>>20)
+	}
+	n, err := io.Copy(dst, io.LimitReader(resp.Body, o.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > o.MaxSize {
+		return fmt.Errorf("download exceeds max_size_mb of %d", o.MaxSize>>20)
+	}
+	return nil
+}
+
+// statusError describes an unexpected response with the start of its body, which
+// usually tells why, e.g. the error page of a proxy
+func statusError(resp *http.Response) error {
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(snippet, &body) == nil && body.Error != "" {
+		return fmt.Errorf("unexpected status %s, agent: %s", resp.Status, body.Error)
+	}
+	text := strings.Join(strings.Fields(strings.ToValidUTF8(string(snippet), "")), " ")
+	if text == "" {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, text)
+}
+
+func (d *HttpDriver) Fetch(way string) (string, error) {
+	levelFilePath, _, err := d.FetchIfChanged(way, "")
+	return levelFilePath, err
+}
+
+// FetchIfChanged asks pst-agent for its manifest and downloads only the files whose hash
+// changed since the last fetch. Servers without manifest send the whole archive.
+// The version is the ETag of the save.
+func (d *HttpDriver) FetchIfChanged(way, version string) (string, string, error) {
+	manifest, err := d.manifest(version)
+	if errors.Is(err, ErrNotSupported) {
+		levelFilePath, etag, err := DownloadFromHttp(d.Url, way, d.Options, version)
+		if err != nil && !errors.Is(err, ErrNotModified) {
+			return "", "", errors.New("error downloading file: " + err.Error())
+		}
+		return levelFilePath, etag, err
+	}
+	if err != nil {
+		return "", "", err
+	}
+	levelFilePath, err := d.fetchManifestFiles(way, manifest)
+	if err != nil {
+		return "", "", errors.New("error downloading file: " + err.Error())
+	}
+	return levelFilePath, manifest.ETag, nil
+}
+
+// agentUrl is the url of a path below the sync url
+func (d *HttpDriver) agentUrl(elem string) string {
+	u, err := url.Parse(d.Url)
+	if err != nil {
+		return d.Url
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + elem
+	return u.String()
+}
+
+func (d *HttpDriver) get(rawUrl, etag string) (*http.Response, error) {
+	return d.Options.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", `"`+etag+`"`)
+		}
+		return req, nil
+	})
+}
+
+// manifest returns ErrNotSupported for agents without manifest endpoint
+func (d *HttpDriver) manifest(etag string) (AgentManifest, error) {
+	resp, err := d.get(d.agentUrl("manifest"), etag)
+	if err != nil {
+		return AgentManifest{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return AgentManifest{}, ErrNotModified
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		if err = agentError(resp); err != nil {
+			return AgentManifest{}, err
+		}
+		return AgentManifest{}, ErrNotSupported
+	default:
+		return AgentManifest{}, statusError(resp)
+	}
+	var manifest AgentManifest
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&manifest); err != nil {
+		return AgentManifest{}, errors.New("error reading agent manifest: " + err.Error())
+	}
+	return manifest, nil
+}
+
+// fetchManifestFiles copies the files of the manifest into a new temporary directory,
+// files are kept in a cache by their hash between fetches
+func (d *HttpDriver) fetchManifestFiles(way string, manifest AgentManifest) (string, error) {
+	httpCacheMu.Lock()
+	defer httpCacheMu.Unlock()
+	sum := sha256.Sum256([]byte(d.Url))
+	cacheDir := filepath.Join(os.TempDir(), "pst-http-"+hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-http-"+way+"-"+uuid.New().String())
+	if err := os.MkdirAll(filepath.Join(tempDir, "Players"), 0755); err != nil {
+		return "", err
+	}
+	keep := make(map[string]bool, len(manifest.Files))
+	downloaded := 0
+	for _, file := range manifest.Files {
+		if strings.Contains(file.Name, "..") || path.IsAbs(file.Name) {
+			os.RemoveAll(tempDir)
+			return "", fmt.Errorf("invalid file name %s in agent manifest", file.Name)
+		}
+		cacheFile := filepath.Join(cacheDir, file.Sha256+".sav")
+		keep[filepath.Base(cacheFile)] = true
+		if _, err := os.Stat(cacheFile); err != nil {
+			if err = d.downloadFile(file, cacheFile); err != nil {
+				os.RemoveAll(tempDir)
+				return "", fmt.Errorf("error downloading %s: %s", file.Name, err)
+			}
+			downloaded++
+		}
+		if err := system.CopyFile(cacheFile, filepath.Join(tempDir, filepath.FromSlash(file.Name))); err != nil {
+			os.RemoveAll(tempDir)
+			return "", err
+		}
+	}
+
+	// drop files no longer in the save
+	if entries, err := os.ReadDir(cacheDir); err == nil {
+		for _, entry := range entries {
+			if !keep[entry.Name()] {
+				os.Remove(filepath.Join(cacheDir, entry.Name()))
+			}
+		}
+	}
+	logger.Infof("%d of %d save files downloaded from %s, the rest were unchanged\n", downloaded, len(manifest.Files), d.Url)
+	return filepath.Join(tempDir, "Level.sav"), nil
+}
+
+// downloadFile downloads a file of the manifest and checks its hash
+func (d *HttpDriver) downloadFile(file AgentFile, dist string) error {
+	resp, err := d.get(d.agentUrl("files/"+file.Name), "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	tempFile := dist + ".part"
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if err = d.Options.copyLimited(io.MultiWriter(out, hash), resp); err != nil {
+		out.Close()
+		os.Remove(tempFile)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != file.Sha256 {
+		os.Remove(tempFile)
+		return errors.New("checksum mismatch, the save changed while downloading")
+	}
+	return os.Rename(tempFile, dist)
+}
+
+// Write uploads the .sav files of srcDir as zip to pst-agent, which keeps a safety
+// copy of the files it replaces
+func (d *HttpDriver) Write(srcDir string) error {
+	logger.Infof("writing savDir to %s\n", d.Url)
+	zipFile := filepath.Join(os.TempDir(), "pst-upload-"+uuid.New().String()+".zip")
+	if err := system.ZipDir(srcDir, zipFile); err != nil {
+		return err
+	}
+	defer os.Remove(zipFile)
+	_, checksum, err := system.Sha256File(zipFile)
+	if err != nil {
+		return err
+	}
+
+	var file *os.File
+	resp, err := d.Options.do(func() (*http.Request, error) {
+		if file != nil {
+			file.Close()
+		}
+		var err error
+		if file, err = os.Open(zipFile); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, d.Url, file)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/zip")
+		req.Header.Set(AgentBodyHashHeader, checksum)
+		return req, nil
+	})
+	if file != nil {
+		defer file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		if err = agentError(resp); err != nil {
+			return err
+		}
+		return fmt.Errorf("agent does not support write-back: %w", ErrNotSupported)
+	}
+	return statusError(resp)
+}
+
+// agentError returns the error pst-agent put in the response body, nil when the
+// body is not one of its json errors, e.g. for routes older agents don't know
+func agentError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body) != nil || body.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("agent: %s", body.Error)
+}
+
+// SavDir returns ".", pst-agent keeps the paths of its host to itself and files are
+// written by their name below its save directory
+func (d *HttpDriver) SavDir() (string, error) {
+	_, err := d.manifest("")
+	if errors.Is(err, ErrNotSupported) {
+		return "", fmt.Errorf("agent does not support write-back: %w", err)
+	}
 	if err != nil {
 		return "", err
 	}
+	return ".", nil
+}
+
+// Stat asks the server for the ETag or Last-Modified of the archive
+func (d *HttpDriver) Stat() (Stat, error) {
+	resp, err := d.Options.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, d.Url, nil)
+	})
+	if err != nil {
+		return Stat{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Stat{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	stat := Stat{Size: resp.ContentLength}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		stat.ModTime = lastModified
+	}
+	version := resp.Header.Get("ETag")
+	if version == "" && !stat.ModTime.IsZero() {
+		version = fmt.Sprintf("%d-%d", stat.ModTime.Unix(), stat.Size)
+	}
+	if version == "" {
+		return Stat{}, fmt.Errorf("server sends neither ETag nor Last-Modified: %w", ErrNotSupported)
+	}
+	sum := sha256.Sum256([]byte(version))
+	stat.Checksum = hex.EncodeToString(sum[:])
+	return stat, nil
+}
+
+func (d *HttpDriver) Watch(ctx context.Context, onChange func(Stat)) error {
+	return watchByStat(ctx, d, 30*time.Second, onChange)
+}
+
+// DownloadFromHttp downloads and extracts sav.zip. With etag set the server may answer
+// 304, which is returned as ErrNotModified. The ETag of the response is returned as well.
+func DownloadFromHttp(url, way string, options HttpOptions, etag string) (string, string, error) {
+	logger.Infof("downloading sav.zip from %s\n", url)
+	resp, err := options.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", `"`+etag+`"`)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return "", "", ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", statusError(resp)
+	}
 
 	uuid := uuid.New().String()
 	tempPath := filepath.Join(os.TempDir(), "palworldsav-http-"+way+"-"+uuid)
 	absPath, err := filepath.Abs(tempPath)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if err = system.CleanAndCreateDir(absPath); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	tempZipFilePath := filepath.Join(absPath, "sav.zip")
@@ -35,20 +526,31 @@ func DownloadFromHttp(url, way string) (string, error) {
 
 	zipOut, err := os.Create(tempZipFilePath)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	defer zipOut.Close()
-
-	_, err = io.Copy(zipOut, resp.Body)
+	hash := sha256.New()
+	err = options.copyLimited(io.MultiWriter(zipOut, hash), resp)
+	zipOut.Close()
 	if err != nil {
-		return "", err
+		os.RemoveAll(absPath)
+		return "", "", err
+	}
+	if options.ChecksumHeader != "" {
+		if expected := resp.Header.Get(options.ChecksumHeader); expected != "" {
+			expected = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(expected), "sha256="), "sha256:")
+			if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+				os.RemoveAll(absPath)
+				return "", "", fmt.Errorf("checksum mismatch, %s is %s but sav.zip has %s", options.ChecksumHeader, expected, actual)
+			}
+		}
 	}
 
 	err = system.UnzipDir(tempZipFilePath, absPath)
 	if err != nil {
-		return "", err
+		os.RemoveAll(absPath)
+		return "", "", err
 	}
 	levelFilePath := filepath.Join(absPath, "Level.sav")
 	logger.Info("sav.zip downloaded and extracted\n")
-	return levelFilePath, nil
+	return levelFilePath, strings.Trim(strings.TrimPrefix(resp.Header.Get("ETag"), "W/"), `"`), nil
 }
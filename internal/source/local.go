@@ -1,38 +1,79 @@
 package source
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/system"
 )
 
-func CopyFromLocal(src, way string) (string, error) {
+func init() {
+	Register("file", func(address string) (Driver, error) {
+		return &LocalDriver{Path: address}, nil
+	})
+}
 
-	isDir, err := system.CheckIsDir(src)
+// LocalDriver reads the save from a local Level.sav or a directory containing it
+type LocalDriver struct {
+	Path string
+}
+
+func (d *LocalDriver) Fetch(way string) (string, error) {
+	levelFilePath, err := CopyFromLocal(d.Path, way)
 	if err != nil {
-		logger.Errorf("error checking if %s is a directory: %v\n", src, err)
+		return "", errors.New("error copying file to temporary directory: " + err.Error())
 	}
+	return levelFilePath, nil
+}
 
-	// 获得Level.sav路径
-	var levelPath string
-	if isDir {
-		levelPath, err = system.GetLevelSavFilePath(src)
+func (d *LocalDriver) Write(srcDir string) error {
+	savDir, err := d.SavDir()
+	if err != nil {
+		return err
+	}
+	return CopyToLocal(srcDir, savDir)
+}
+
+func (d *LocalDriver) SavDir() (string, error) {
+	return LocateLocalSavDir(d.Path)
+}
+
+func (d *LocalDriver) Stat() (Stat, error) {
+	savDir, err := d.SavDir()
+	if err != nil {
+		return Stat{}, err
+	}
+	names, err := system.ListSavFiles(savDir)
+	if err != nil {
+		return Stat{}, err
+	}
+	listing := ""
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(savDir, filepath.FromSlash(name)))
 		if err != nil {
-			return "", errors.New("error finding Level.sav: \n" + err.Error())
-		}
-	} else {
-		if filepath.Base(src) == "Level.sav" {
-			levelPath = src
-		} else {
-			return "", errors.New("specified file is not Level.sav and source is not a directory")
+			return Stat{}, err
 		}
+		listing += fmt.Sprintf("./%s %d %d\n", name, info.Size(), info.ModTime().Unix())
+	}
+	return statFromListing(listing)
+}
+
+func (d *LocalDriver) Watch(ctx context.Context, onChange func(Stat)) error {
+	return watchByStat(ctx, d, 5*time.Second, onChange)
+}
+
+func CopyFromLocal(src, way string) (string, error) {
+	savDir, err := LocateLocalSavDir(src)
+	if err != nil {
+		return "", err
 	}
-	savDir := filepath.Dir(levelPath)
 
 	// 创建临时目录
 	randId := uuid.New().String()
@@ -61,3 +102,61 @@ func CopyFromLocal(src, way string) (string, error) {
 	distLevelPath := filepath.Join(tempDir, "Level.sav")
 	return distLevelPath, nil
 }
+
+// LocateLocalSavDir returns the directory containing Level.sav for a local save.path
+func LocateLocalSavDir(src string) (string, error) {
+	isDir, err := system.CheckIsDir(src)
+	if err != nil {
+		logger.Errorf("error checking if %s is a directory: %v\n", src, err)
+	}
+
+	// 获得Level.sav路径
+	var levelPath string
+	if isDir {
+		levelPath, err = system.GetLevelSavFilePath(src)
+		if err != nil {
+			return "", errors.New("error finding Level.sav: \n" + err.Error())
+		}
+	} else {
+		if filepath.Base(src) == "Level.sav" {
+			levelPath = src
+		} else {
+			return "", errors.New("specified file is not Level.sav and source is not a directory")
+		}
+	}
+	return filepath.Dir(levelPath), nil
+}
+
+// CopyToLocal writes the .sav files of srcDir into savDir. Every file is copied next to
+// its target first and only then renamed over it, so a failed copy changes nothing.
+func CopyToLocal(srcDir, savDir string) error {
+	logger.Infof("writing savDir to %s\n", savDir)
+
+	names, err := system.ListSavFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	tempFiles := make([]string, 0, len(names))
+	defer func() {
+		for _, tempFile := range tempFiles {
+			os.Remove(tempFile)
+		}
+	}()
+	for _, name := range names {
+		dist := filepath.Join(savDir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(dist), 0755); err != nil {
+			return err
+		}
+		tempFile := dist + ".pst-tmp"
+		tempFiles = append(tempFiles, tempFile)
+		if err = system.CopyFile(filepath.Join(srcDir, filepath.FromSlash(name)), tempFile); err != nil {
+			return err
+		}
+	}
+	for i, name := range names {
+		if err = os.Rename(tempFiles[i], filepath.Join(savDir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
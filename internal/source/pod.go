@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,54 +18,225 @@ import (
 	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/system"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
 var (
 	ErrPodNotFound    = errors.New("pod not found")
+	ErrPodNotReady    = errors.New("pod is not ready")
 	ErrContainerEmpty = errors.New("container empty")
 	ErrAddressInvalid = errors.New("invalid save.path, eg: k8s://namespace/podName:filePath")
 )
 
-func CopyFromPod(namespace, podName, container, remotePath, way string) (string, error) {
-	logger.Infof("copying savDir from %s:%s\n", container, remotePath)
-	config, err := rest.InClusterConfig()
+const defaultPodTimeout = time.Minute
+
+func init() {
+	Register("k8s", func(address string) (Driver, error) {
+		return ParseK8sDriver(address)
+	})
+}
+
+// K8sDriver reads the save from a pod container,
+// k8s://namespace/pod/container:remotePath?kubeconfig=...&context=...&timeout=60
+// Pod may be a label selector such as app=palworld, the Ready pod it matches is used.
+type K8sDriver struct {
+	Namespace string
+	Pod       string
+	Container string
+	Path      string
+	// Kubeconfig and Context select a cluster from outside, KUBECONFIG is used when empty.
+	// Without either PST must run inside the cluster.
+	Kubeconfig string
+	Context    string
+	// Timeout limits api requests and commands run in the pod, copies get 5 times as long
+	Timeout time.Duration
+}
+
+// ParseK8sDriver parses a k8s save.path with its optional kubeconfig, context and
+// timeout (seconds) query parameters
+func ParseK8sDriver(address string) (*K8sDriver, error) {
+	var query url.Values
+	if i := strings.LastIndex(address, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(address[i+1:]); err != nil {
+			return nil, errors.New("error parsing k8s address: " + err.Error())
+		}
+		address = address[:i]
+	}
+	namespace, podName, container, remotePath, err := ParseK8sAddress(address)
 	if err != nil {
-		return "", errors.New("error getting in-cluster config: " + err.Error())
+		return nil, errors.New("error parsing k8s address: " + err.Error())
 	}
+	if container == "" {
+		return nil, ErrContainerEmpty
+	}
+	driver := &K8sDriver{
+		Namespace:  namespace,
+		Pod:        podName,
+		Container:  container,
+		Path:       remotePath,
+		Kubeconfig: query.Get("kubeconfig"),
+		Context:    query.Get("context"),
+		Timeout:    defaultPodTimeout,
+	}
+	if timeout := query.Get("timeout"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid k8s timeout %s", timeout)
+		}
+		driver.Timeout = time.Duration(seconds) * time.Second
+	}
+	return driver, nil
+}
+
+// podSession is a connection to the container of a resolved, Ready pod
+type podSession struct {
+	clientset *kubernetes.Clientset
+	config    *rest.Config
+	namespace string
+	pod       string
+	container string
+	timeout   time.Duration
+}
+
+func (d *K8sDriver) restConfig() (*rest.Config, string, error) {
+	if d.Kubeconfig == "" && d.Context == "" && os.Getenv("KUBECONFIG") == "" {
+		if config, err := rest.InClusterConfig(); err == nil {
+			namespace, err := getCurrentNamespace()
+			if err != nil {
+				return nil, "", errors.New("error getting current namespace: " + err.Error())
+			}
+			return config, namespace, nil
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if d.Kubeconfig != "" {
+		rules.ExplicitPath = d.Kubeconfig
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: d.Context})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", errors.New("error loading kubeconfig: " + err.Error())
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", errors.New("error getting kubeconfig namespace: " + err.Error())
+	}
+	return config, namespace, nil
+}
+
+func (d *K8sDriver) connect() (*podSession, error) {
+	config, namespace, err := d.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = d.Timeout
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return "", errors.New("error getting clientset: " + err.Error())
+		return nil, errors.New("error getting clientset: " + err.Error())
+	}
+	if d.Namespace != "" {
+		namespace = d.Namespace
 	}
 
-	if namespace == "" {
-		var err error
-		namespace, err = getCurrentNamespace()
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	podName, err := resolvePod(ctx, clientset, namespace, d.Pod)
+	if err != nil {
+		return nil, err
+	}
+	return &podSession{
+		clientset: clientset,
+		config:    config,
+		namespace: namespace,
+		pod:       podName,
+		container: d.Container,
+		timeout:   d.Timeout,
+	}, nil
+}
+
+// resolvePod returns the name of a Ready pod, podName is a pod name or a label selector
+func resolvePod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) (string, error) {
+	if !strings.Contains(podName, "=") {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 		if err != nil {
-			return "", errors.New("error getting current namespace: " + err.Error())
+			return "", fmt.Errorf("%w: %s/%s: %s", ErrPodNotFound, namespace, podName, err)
+		}
+		if !isPodReady(pod) {
+			return "", fmt.Errorf("%w: %s/%s is %s", ErrPodNotReady, namespace, podName, pod.Status.Phase)
 		}
+		return pod.Name, nil
 	}
 
-	if container == "" {
-		return "", ErrContainerEmpty
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: podName})
+	if err != nil {
+		return "", fmt.Errorf("error listing pods matching %s: %s", podName, err)
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("%w: no pod in %s matches %s", ErrPodNotFound, namespace, podName)
+	}
+	var ready []corev1.Pod
+	var states []string
+	for _, pod := range pods.Items {
+		if isPodReady(&pod) {
+			ready = append(ready, pod)
+		}
+		states = append(states, fmt.Sprintf("%s %s", pod.Name, pod.Status.Phase))
+	}
+	if len(ready) == 0 {
+		return "", fmt.Errorf("%w: no pod matching %s is Ready (%s)", ErrPodNotReady, podName, strings.Join(states, ", "))
 	}
+	// the newest pod is the one a rollout has just brought up
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].CreationTimestamp.After(ready[j].CreationTimestamp.Time)
+	})
+	if len(ready) > 1 {
+		logger.Warnf("%d Ready pods match %s, using %s\n", len(ready), podName, ready[0].Name)
+	}
+	return ready[0].Name, nil
+}
 
-	findCmd := []string{"sh", "-c", fmt.Sprintf("find %s -maxdepth 4 -path '*/backup/*' -prune -o -name 'Level.sav' -print | xargs dirname", remotePath)}
-	savDir, err := execPodCommand(clientset, config, namespace, podName, container, findCmd)
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (d *K8sDriver) Fetch(way string) (string, error) {
+	levelFilePath, err := d.copyFromPod(way)
 	if err != nil {
-		return "", errors.New("error executing find command: " + err.Error())
+		return "", errors.New("error copying file from pod: " + err.Error())
 	}
-	savDir = strings.TrimSpace(savDir)
-	if savDir == "" {
-		return "", errors.New("directory containing Level.sav not found in Pod")
+	return levelFilePath, nil
+}
+
+func (d *K8sDriver) copyFromPod(way string) (string, error) {
+	logger.Infof("copying savDir from %s:%s\n", d.Container, d.Path)
+	session, err := d.connect()
+	if err != nil {
+		return "", err
+	}
+	savDir, err := session.locateSavDir(d.Path)
+	if err != nil {
+		return "", err
 	}
-	logger.Debugf("Directory path: %s\n", savDir)
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*session.timeout)
+	defer cancel()
 	tarCmd := []string{"sh", "-c", fmt.Sprintf("cd \"%s\" && tar czf - ./*.sav ./Players/*.sav", savDir)}
-	tarStream, err := execPodCommandStream(clientset, config, namespace, podName, container, tarCmd)
+	tarStream, err := session.execStream(ctx, tarCmd)
 	if err != nil {
 		return "", errors.New("error executing tar command: " + err.Error())
 	}
@@ -76,6 +250,7 @@ func CopyFromPod(namespace, podName, container, remotePath, way string) (string,
 
 	err = system.UnTarGzDir(tarStream, tempDir)
 	if err != nil {
+		os.RemoveAll(tempDir)
 		return "", err
 	}
 
@@ -85,93 +260,139 @@ func CopyFromPod(namespace, podName, container, remotePath, way string) (string,
 	return levelFilePath, nil
 }
 
-func getCurrentNamespace() (string, error) {
-	ns, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+// Write writes the .sav files of srcDir into the save directory inside the pod container
+func (d *K8sDriver) Write(srcDir string) error {
+	session, err := d.connect()
 	if err != nil {
-		return "", err
+		return err
 	}
-	return strings.TrimSpace(string(ns)), nil
-}
+	savDir, err := session.locateSavDir(d.Path)
+	if err != nil {
+		return err
+	}
+	logger.Infof("writing savDir to %s/%s:%s\n", session.pod, session.container, savDir)
 
-func execPodCommand(clientset *kubernetes.Clientset, config *rest.Config, namespace, podName, container string, cmd []string) (string, error) {
-	req := clientset.CoreV1().RESTClient().
-		Post().
-		Resource("pods").
-		Name(podName).
-		Namespace(namespace).
-		SubResource("exec").
-		VersionedParams(&corev1.PodExecOptions{
-			Command:   cmd,
-			Stdin:     false,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-			Container: container,
-		}, scheme.ParameterCodec)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(system.TarSavDir(srcDir, writer, true, 0, 0))
+	}()
+	defer reader.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*session.timeout)
 	defer cancel()
+	var stdout, stderr bytes.Buffer
+	err = session.stream(ctx, []string{"tar", "xzof", "-", "-C", savDir}, reader, &stdout, &stderr)
+	if err != nil {
+		return errors.New("error executing tar command: " + err.Error() + " " + stderr.String())
+	}
+	return nil
+}
 
-	executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+func (d *K8sDriver) SavDir() (string, error) {
+	session, err := d.connect()
 	if err != nil {
 		return "", err
 	}
+	return session.locateSavDir(d.Path)
+}
 
-	var stdout, stderr bytes.Buffer
-	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdin:  nil,
-		Stdout: &stdout,
-		Stderr: &stderr,
-	})
+func (d *K8sDriver) Stat() (Stat, error) {
+	session, err := d.connect()
 	if err != nil {
-		return "", err
+		return Stat{}, err
 	}
+	savDir, err := session.locateSavDir(d.Path)
+	if err != nil {
+		return Stat{}, err
+	}
+	listing, err := session.exec(statListCmd(savDir))
+	if err != nil {
+		return Stat{}, err
+	}
+	return statFromListing(listing)
+}
 
-	if stderr.Len() > 0 {
-		return "", errors.New(stderr.String())
+func (d *K8sDriver) Watch(ctx context.Context, onChange func(Stat)) error {
+	return watchByStat(ctx, d, 30*time.Second, onChange)
+}
+
+func (s *podSession) locateSavDir(remotePath string) (string, error) {
+	findCmd := []string{"sh", "-c", fmt.Sprintf("find %s -maxdepth 4 -path '*/backup/*' -prune -o -name 'Level.sav' -print | xargs dirname", remotePath)}
+	savDir, err := s.exec(findCmd)
+	if err != nil {
+		return "", errors.New("error executing find command: " + err.Error())
 	}
+	savDir = strings.TrimSpace(savDir)
+	if savDir == "" {
+		return "", errors.New("directory containing Level.sav not found in Pod")
+	}
+	logger.Debugf("Directory path: %s\n", savDir)
+	return savDir, nil
+}
 
-	return stdout.String(), nil
+func getCurrentNamespace() (string, error) {
+	ns, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
 }
 
-func execPodCommandStream(clientset *kubernetes.Clientset, config *rest.Config, namespace, podName, container string, cmd []string) (io.Reader, error) {
-	req := clientset.CoreV1().RESTClient().
+func (s *podSession) stream(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := s.clientset.CoreV1().RESTClient().
 		Post().
 		Resource("pods").
-		Name(podName).
-		Namespace(namespace).
+		Name(s.pod).
+		Namespace(s.namespace).
 		SubResource("exec").
 		VersionedParams(&corev1.PodExecOptions{
 			Command:   cmd,
-			Stdin:     false,
+			Stdin:     stdin != nil,
 			Stdout:    true,
 			Stderr:    true,
 			TTY:       false,
-			Container: container,
+			Container: s.container,
 		}, scheme.ParameterCodec)
 
-	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	executor, err := remotecommand.NewSPDYExecutor(s.config, "POST", req.URL())
 	if err != nil {
-		return nil, err
+		return err
 	}
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command in pod %s timed out", s.pod)
+	}
+	return err
+}
 
-	reader, writer := io.Pipe()
-
-	ctx, cancel := context.WithCancel(context.Background())
+func (s *podSession) exec(cmd []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
 
+	var stdout, stderr bytes.Buffer
+	if err := s.stream(ctx, cmd, nil, &stdout, &stderr); err != nil {
+		return "", err
+	}
+	if stderr.Len() > 0 {
+		return "", errors.New(stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// execStream runs cmd and returns its stdout as it arrives, ctx bounds the whole stream
+func (s *podSession) execStream(ctx context.Context, cmd []string) (io.Reader, error) {
+	reader, writer := io.Pipe()
 	go func() {
-		defer writer.Close()
-		err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
-			Stdout: writer,
-			Stderr: os.Stderr,
-		})
+		err := s.stream(ctx, cmd, nil, writer, os.Stderr)
 		if err != nil {
 			logger.Errorf("Stream to pod failed: %v", err)
-			cancel()
 		}
+		writer.CloseWithError(err)
 	}()
-
 	return reader, nil
 }
 
@@ -184,11 +405,13 @@ func ParseK8sAddress(address string) (namespace, pod, container, filePath string
 	}
 
 	pathParts := strings.Split(parts[0], "/")
-	switch len(pathParts) {
-	case 2: // podname  container
+	switch {
+	case len(pathParts) == 2: // podname  container
 		pod, container = pathParts[0], pathParts[1]
-	case 3: // namespace  podname  container
-		namespace, pod, container = pathParts[0], pathParts[1], pathParts[2]
+	case len(pathParts) >= 3: // namespace  podname or label selector  container
+		// label keys may have a prefix with a slash, app.kubernetes.io/name=palworld
+		namespace, container = pathParts[0], pathParts[len(pathParts)-1]
+		pod = strings.Join(pathParts[1:len(pathParts)-1], "/")
 	default:
 		return "", "", "", "", errors.New("invalid path format")
 	}
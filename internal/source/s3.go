@@ -0,0 +1,309 @@
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+func init() {
+	Register("s3", func(address string) (Driver, error) {
+		return ParseS3Address(address)
+	})
+}
+
+// s3CacheMu guards the object caches, shared by every driver of the same location
+var s3CacheMu sync.Mutex
+
+// S3Driver reads the save from S3 compatible object storage,
+// s3://bucket/prefix?endpoint=...&region=...&use_ssl=false
+type S3Driver struct {
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	client   *minio.Client
+}
+
+// S3Options are the settings of an s3 address kept out of the url, Endpoint and Region
+// override the query when set
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+type s3Object struct {
+	Key          string
+	Name         string // slash separated name below the save directory
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// ParseS3Address parses an s3 save.path, the credentials are read from the AWS_* or
+// MINIO_* environment variables or the instance role
+func ParseS3Address(address string) (*S3Driver, error) {
+	return NewS3Driver(address, S3Options{})
+}
+
+// NewS3Driver parses an s3 save.path with the settings of save.s3. Without AccessKey
+// the credentials are read from the AWS_* or MINIO_* environment variables or the
+// instance role. Credentials in the query are refused, they would end up in logs and
+// a + in the secret would be read as a space.
+func NewS3Driver(address string, options S3Options) (*S3Driver, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.New("error parsing s3 address: " + err.Error())
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid s3 address, eg: s3://bucket/path/to/Saved?endpoint=minio:9000")
+	}
+	query := u.Query()
+	if query.Has("access_key") || query.Has("secret_key") {
+		return nil, errors.New("s3 credentials in save.path are not supported, set save.s3.access_key and save.s3.secret_key or the AWS_* environment variables")
+	}
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = query.Get("endpoint")
+	}
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	region := options.Region
+	if region == "" {
+		region = query.Get("region")
+	}
+
+	var creds *credentials.Credentials
+	if options.AccessKey != "" {
+		creds = credentials.NewStaticV4(options.AccessKey, options.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{},
+		})
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: query.Get("use_ssl") != "false",
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Driver{
+		Endpoint: endpoint,
+		Bucket:   u.Host,
+		Prefix:   strings.Trim(u.Path, "/"),
+		client:   client,
+	}, nil
+}
+
+// listSavObjects finds the directory holding Level.sav below the prefix and returns it
+// with its *.sav and Players/*.sav objects
+func (d *S3Driver) listSavObjects(ctx context.Context) (string, []s3Object, error) {
+	prefix := d.Prefix
+	if path.Base(prefix) == "Level.sav" {
+		prefix = path.Dir(prefix)
+		if prefix == "." {
+			prefix = ""
+		}
+	}
+	listPrefix := prefix
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+
+	var objects []minio.ObjectInfo
+	for object := range d.client.ListObjects(ctx, d.Bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return "", nil, object.Err
+		}
+		objects = append(objects, object)
+	}
+
+	// the shallowest Level.sav wins, the game keeps older copies in backup directories
+	savDir, bestDepth := "", -1
+	for _, object := range objects {
+		rel := strings.TrimPrefix(object.Key, listPrefix)
+		if path.Base(rel) != "Level.sav" {
+			continue
+		}
+		dir := path.Dir(rel)
+		depth := 0
+		if dir != "." {
+			depth = strings.Count(dir, "/") + 1
+		}
+		if depth > 4 || strings.Contains("/"+dir+"/", "/backup/") {
+			continue
+		}
+		if bestDepth < 0 || depth < bestDepth {
+			savDir, bestDepth = dir, depth
+		}
+	}
+	if bestDepth < 0 {
+		return "", nil, errors.New("Level.sav not found in bucket")
+	}
+	if savDir == "." {
+		savDir = prefix
+	} else {
+		savDir = path.Join(prefix, savDir)
+	}
+
+	savPrefix := savDir
+	if savPrefix != "" {
+		savPrefix += "/"
+	}
+	var savObjects []s3Object
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, savPrefix) || !strings.HasSuffix(object.Key, ".sav") {
+			continue
+		}
+		name := strings.TrimPrefix(object.Key, savPrefix)
+		if strings.Contains(name, "/") && path.Dir(name) != "Players" {
+			continue
+		}
+		savObjects = append(savObjects, s3Object{
+			Key:          object.Key,
+			Name:         name,
+			ETag:         object.ETag,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	return savDir, savObjects, nil
+}
+
+// cacheDir is kept between fetches so objects with an unchanged ETag are not downloaded again
+func (d *S3Driver) cacheDir() string {
+	sum := sha256.Sum256([]byte(d.Endpoint + "/" + d.Bucket + "/" + d.Prefix))
+	return filepath.Join(os.TempDir(), "pst-s3-"+hex.EncodeToString(sum[:8]))
+}
+
+func (d *S3Driver) Fetch(way string) (string, error) {
+	logger.Infof("copying savDir from s3://%s/%s\n", d.Bucket, d.Prefix)
+	ctx := context.Background()
+	_, objects, err := d.listSavObjects(ctx)
+	if err != nil {
+		return "", errors.New("error listing bucket: " + err.Error())
+	}
+
+	s3CacheMu.Lock()
+	defer s3CacheMu.Unlock()
+	cacheDir := d.cacheDir()
+	if err = os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	index := make(map[string]string)
+	indexFile := filepath.Join(cacheDir, "index.json")
+	if data, err := os.ReadFile(indexFile); err == nil {
+		json.Unmarshal(data, &index)
+	}
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-s3-"+way+"-"+uuid.New().String())
+	if err = os.MkdirAll(filepath.Join(tempDir, "Players"), 0755); err != nil {
+		return "", err
+	}
+	newIndex := make(map[string]string, len(objects))
+	downloaded := 0
+	for _, object := range objects {
+		sum := sha256.Sum256([]byte(object.Key))
+		cacheFile := filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".sav")
+		if _, statErr := os.Stat(cacheFile); statErr != nil || index[object.Key] != object.ETag {
+			if err = d.client.FGetObject(ctx, d.Bucket, object.Key, cacheFile, minio.GetObjectOptions{}); err != nil {
+				os.RemoveAll(tempDir)
+				return "", fmt.Errorf("error downloading %s: %s", object.Key, err)
+			}
+			downloaded++
+		}
+		newIndex[object.Key] = object.ETag
+		if err = system.CopyFile(cacheFile, filepath.Join(tempDir, filepath.FromSlash(object.Name))); err != nil {
+			os.RemoveAll(tempDir)
+			return "", err
+		}
+	}
+
+	// drop objects that are gone from the bucket
+	for key := range index {
+		if _, ok := newIndex[key]; !ok {
+			sum := sha256.Sum256([]byte(key))
+			os.Remove(filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".sav"))
+		}
+	}
+	if data, err := json.Marshal(newIndex); err == nil {
+		os.WriteFile(indexFile, data, 0644)
+	}
+	logger.Debugf("%d of %d save objects downloaded, the rest were unchanged\n", downloaded, len(objects))
+	return filepath.Join(tempDir, "Level.sav"), nil
+}
+
+func (d *S3Driver) Write(srcDir string) error {
+	ctx := context.Background()
+	savDir, _, err := d.listSavObjects(ctx)
+	if err != nil {
+		return errors.New("error listing bucket: " + err.Error())
+	}
+	logger.Infof("writing savDir to s3://%s/%s\n", d.Bucket, savDir)
+	names, err := system.ListSavFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		_, err = d.client.FPutObject(ctx, d.Bucket, path.Join(savDir, name), filepath.Join(srcDir, filepath.FromSlash(name)), minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *S3Driver) SavDir() (string, error) {
+	savDir, _, err := d.listSavObjects(context.Background())
+	return savDir, err
+}
+
+// Stat lists the save objects, the checksum is built from their ETags
+func (d *S3Driver) Stat() (Stat, error) {
+	_, objects, err := d.listSavObjects(context.Background())
+	if err != nil {
+		return Stat{}, err
+	}
+	var stat Stat
+	lines := make([]string, 0, len(objects))
+	for _, object := range objects {
+		stat.Size += object.Size
+		if object.LastModified.After(stat.ModTime) {
+			stat.ModTime = object.LastModified
+		}
+		lines = append(lines, object.Name+" "+object.ETag)
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	stat.Checksum = hex.EncodeToString(sum[:])
+	return stat, nil
+}
+
+func (d *S3Driver) Watch(ctx context.Context, onChange func(Stat)) error {
+	return watchByStat(ctx, d, 30*time.Second, onChange)
+}
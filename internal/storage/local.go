@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+type localTarget struct {
+	name string
+	dir  string
+}
+
+func newLocalTarget(cfg config.BackupTarget) (*localTarget, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("local backup target requires a path")
+	}
+	dir, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &localTarget{name: cfg.Name, dir: dir}, nil
+}
+
+func (t *localTarget) Name() string {
+	return t.name
+}
+
+func (t *localTarget) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dist := filepath.Join(t.dir, filepath.FromSlash(key))
+	if err := system.CheckAndCreateDir(filepath.Dir(dist)); err != nil {
+		return err
+	}
+	tempFile := dist + ".pst-tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, dist)
+}
+
+func (t *localTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(t.dir, filepath.FromSlash(key)))
+}
+
+func (t *localTarget) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(t.dir, filepath.FromSlash(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+)
+
+type s3Target struct {
+	name   string
+	bucket string
+	prefix string
+	client *minio.Client
+}
+
+func newS3Target(cfg config.BackupTarget) (*s3Target, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 backup target requires an endpoint and a bucket")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Target{
+		name:   cfg.Name,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Path, "/"),
+		client: client,
+	}, nil
+}
+
+func (t *s3Target) Name() string {
+	return t.name
+}
+
+func (t *s3Target) objectName(key string) string {
+	return path.Join(t.prefix, key)
+}
+
+func (t *s3Target) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := t.client.PutObject(ctx, t.bucket, t.objectName(key), r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (t *s3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := t.client.GetObject(ctx, t.bucket, t.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat it so a missing object fails here
+	if _, err = object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+func (t *s3Target) Delete(ctx context.Context, key string) error {
+	return t.client.RemoveObject(ctx, t.bucket, t.objectName(key), minio.RemoveObjectOptions{})
+}
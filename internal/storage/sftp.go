@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SshAuth holds the credentials and host verification settings of an ssh connection
+type SshAuth struct {
+	Username              string
+	Password              string
+	PrivateKey            string
+	KnownHosts            string
+	InsecureIgnoreHostKey bool
+	Timeout               time.Duration
+}
+
+// DialSftp opens an sftp session over a new ssh connection, close it with the returned func
+func DialSftp(address string, auth SshAuth) (*sftp.Client, func(), error) {
+	sshConfig, err := newSshClientConfig(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	conn, err := ssh.Dial("tcp", address, sshConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+	}, nil
+}
+
+func newSshClientConfig(auth SshAuth) (*ssh.ClientConfig, error) {
+	var methods []ssh.AuthMethod
+	if auth.PrivateKey != "" {
+		key := []byte(auth.PrivateKey)
+		if !strings.HasPrefix(strings.TrimSpace(auth.PrivateKey), "-----BEGIN") {
+			var err error
+			key, err = os.ReadFile(auth.PrivateKey)
+			if err != nil {
+				return nil, errors.New("error reading private key: " + err.Error())
+			}
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, errors.New("error parsing private key: " + err.Error())
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if auth.Password != "" {
+		methods = append(methods, ssh.Password(auth.Password))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("ssh requires a password or a private key")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if auth.InsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		if auth.KnownHosts == "" {
+			return nil, errors.New("ssh requires known_hosts unless insecure_ignore_host_key is set")
+		}
+		var err error
+		hostKeyCallback, err = knownhosts.New(auth.KnownHosts)
+		if err != nil {
+			return nil, errors.New("error loading known_hosts: " + err.Error())
+		}
+	}
+
+	timeout := auth.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &ssh.ClientConfig{
+		User:            auth.Username,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+type sftpTarget struct {
+	name    string
+	address string
+	dir     string
+	auth    SshAuth
+}
+
+func newSftpTarget(cfg config.BackupTarget) (*sftpTarget, error) {
+	if cfg.Address == "" || cfg.Path == "" {
+		return nil, errors.New("sftp backup target requires an address and a path")
+	}
+	return &sftpTarget{
+		name:    cfg.Name,
+		address: cfg.Address,
+		dir:     cfg.Path,
+		auth: SshAuth{
+			Username:              cfg.Username,
+			Password:              cfg.Password,
+			PrivateKey:            cfg.PrivateKey,
+			KnownHosts:            cfg.KnownHosts,
+			InsecureIgnoreHostKey: cfg.InsecureIgnoreHostKey,
+		},
+	}, nil
+}
+
+func (t *sftpTarget) Name() string {
+	return t.name
+}
+
+func (t *sftpTarget) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	client, closeFn, err := DialSftp(t.address, t.auth)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	dist := path.Join(t.dir, key)
+	if err = client.MkdirAll(path.Dir(dist)); err != nil {
+		return err
+	}
+	tempFile := dist + ".pst-tmp"
+	file, err := client.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	if _, err = file.ReadFrom(r); err != nil {
+		file.Close()
+		client.Remove(tempFile)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		client.Remove(tempFile)
+		return err
+	}
+	client.Remove(dist)
+	return client.Rename(tempFile, dist)
+}
+
+func (t *sftpTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	client, closeFn, err := DialSftp(t.address, t.auth)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.Open(path.Join(t.dir, key))
+	if err != nil {
+		closeFn()
+		return nil, err
+	}
+	return &sftpReadCloser{File: file, closeFn: closeFn}, nil
+}
+
+func (t *sftpTarget) Delete(ctx context.Context, key string) error {
+	client, closeFn, err := DialSftp(t.address, t.auth)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	err = client.Remove(path.Join(t.dir, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type sftpReadCloser struct {
+	*sftp.File
+	closeFn func()
+}
+
+func (f *sftpReadCloser) Close() error {
+	err := f.File.Close()
+	f.closeFn()
+	return err
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zaigie/palworld-server-tool/internal/config"
+)
+
+var ErrUnknownType = errors.New("unknown backup target type")
+
+// Target stores backup archives under slash separated keys
+type Target interface {
+	Name() string
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// New creates the target described by cfg
+func New(cfg config.BackupTarget) (Target, error) {
+	switch cfg.Type {
+	case "local":
+		return newLocalTarget(cfg)
+	case "s3":
+		return newS3Target(cfg)
+	case "sftp":
+		return newSftpTarget(cfg)
+	case "webdav":
+		return newWebdavTarget(cfg)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, cfg.Type)
+	}
+}
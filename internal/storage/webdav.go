@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/studio-b12/gowebdav"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+)
+
+type webdavTarget struct {
+	name   string
+	dir    string
+	client *gowebdav.Client
+}
+
+func newWebdavTarget(cfg config.BackupTarget) (*webdavTarget, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("webdav backup target requires an address")
+	}
+	return &webdavTarget{
+		name:   cfg.Name,
+		dir:    path.Join("/", cfg.Path),
+		client: gowebdav.NewClient(cfg.Address, cfg.Username, cfg.Password),
+	}, nil
+}
+
+func (t *webdavTarget) Name() string {
+	return t.name
+}
+
+func (t *webdavTarget) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dist := path.Join(t.dir, key)
+	if err := t.client.MkdirAll(path.Dir(dist), 0755); err != nil {
+		return err
+	}
+	return t.client.WriteStream(dist, r, 0644)
+}
+
+func (t *webdavTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return t.client.ReadStream(path.Join(t.dir, key))
+}
+
+func (t *webdavTarget) Delete(ctx context.Context, key string) error {
+	err := t.client.Remove(path.Join(t.dir, key))
+	if err != nil && !gowebdav.IsErrCode(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
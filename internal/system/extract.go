@@ -0,0 +1,121 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafeArchive is returned for archives that would write outside the destination,
+// contain links or exceed the extraction limits
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// ExtractLimits bound what a single archive may unpack, a zero value means no limit
+type ExtractLimits struct {
+	MaxFiles     int
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+// DefaultExtractLimits apply to every archive extracted by PST, they leave plenty of room
+// for a save with its player files while stopping zip bombs before they fill the disk
+var DefaultExtractLimits = ExtractLimits{
+	MaxFiles:     10000,
+	MaxFileSize:  4 << 30,
+	MaxTotalSize: 16 << 30,
+}
+
+// Extractor writes archive entries below Dir, validating names and counting against Limits
+type Extractor struct {
+	Dir    string
+	Limits ExtractLimits
+	files  int
+	total  int64
+}
+
+func NewExtractor(destDir string) *Extractor {
+	return &Extractor{Dir: destDir, Limits: DefaultExtractLimits}
+}
+
+// SafeJoin joins the slash or backslash separated entry name onto destDir, rejecting
+// absolute names, drive letters and names leaving destDir
+func SafeJoin(destDir, name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || hasDriveLetter(clean) || filepath.VolumeName(filepath.FromSlash(clean)) != "" {
+		return "", fmt.Errorf("%w: invalid entry name %s", ErrUnsafeArchive, name)
+	}
+	return filepath.Join(destDir, filepath.FromSlash(clean)), nil
+}
+
+// hasDriveLetter reports a windows drive like C: at the start of name, checked on every
+// platform since archives may come from windows hosts
+func hasDriveLetter(name string) bool {
+	return len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z')
+}
+
+// Mkdir creates the directory of an entry
+func (e *Extractor) Mkdir(name string) error {
+	target, err := SafeJoin(e.Dir, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+// WriteFile writes the content of an entry, size is the size the archive claims
+// or -1 when unknown, the actual content is limited either way
+func (e *Extractor) WriteFile(name string, r io.Reader, size int64, mode os.FileMode) error {
+	target, err := SafeJoin(e.Dir, name)
+	if err != nil {
+		return err
+	}
+	e.files++
+	if e.Limits.MaxFiles > 0 && e.files > e.Limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrUnsafeArchive, e.Limits.MaxFiles)
+	}
+	limit := e.remaining()
+	if limit >= 0 && size > limit {
+		return fmt.Errorf("%w: %s exceeds the size limit", ErrUnsafeArchive, name)
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// never group or world writable, whatever permissions the archive asks for
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()&0755|0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(out, r)
+	e.total += n
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && n > limit {
+		return fmt.Errorf("%w: %s exceeds the size limit", ErrUnsafeArchive, name)
+	}
+	return out.Close()
+}
+
+// remaining is the most the next file may hold, -1 for no limit
+func (e *Extractor) remaining() int64 {
+	limit := int64(-1)
+	if e.Limits.MaxFileSize > 0 {
+		limit = e.Limits.MaxFileSize
+	}
+	if e.Limits.MaxTotalSize > 0 {
+		left := max(e.Limits.MaxTotalSize-e.total, 0)
+		if limit < 0 || left < limit {
+			limit = left
+		}
+	}
+	return limit
+}
@@ -0,0 +1,269 @@
+package system
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "dest")
+	tests := []struct {
+		name string
+		want string // slash separated below dest, empty when rejected
+	}{
+		{"Level.sav", "Level.sav"},
+		{"Players/0001.sav", "Players/0001.sav"},
+		{"./Level.sav", "Level.sav"},
+		{"Players/../Level.sav", "Level.sav"},
+		{"Players\\0001.sav", "Players/0001.sav"},
+		{"Players/", "Players"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../Level.sav", ""},
+		{"Players/../../Level.sav", ""},
+		{"/etc/passwd", ""},
+		{"/Level.sav", ""},
+		{"..\\Level.sav", ""},
+		{"Players\\..\\..\\Level.sav", ""},
+		{"\\Windows\\System32\\evil.dll", ""},
+		{"C:\\Windows\\System32\\evil.dll", ""},
+		{"C:/Windows/evil.dll", ""},
+		{"c:evil.sav", ""},
+		{"\\\\server\\share\\evil.sav", ""},
+	}
+	for _, tt := range tests {
+		got, err := SafeJoin(dest, tt.name)
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnsafeArchive) {
+				t.Errorf("SafeJoin(%q) = %q, %v, want ErrUnsafeArchive", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SafeJoin(%q): %v", tt.name, err)
+			continue
+		}
+		if want := filepath.Join(dest, filepath.FromSlash(tt.want)); got != want {
+			t.Errorf("SafeJoin(%q) = %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+type zipEntry struct {
+	name string
+	mode os.FileMode
+	body string
+}
+
+func writeZip(t *testing.T, entries []zipEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipFile := filepath.Join(t.TempDir(), "sav.zip")
+	if err := os.WriteFile(zipFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return zipFile
+}
+
+func writeTarGz(t *testing.T, headers []*tar.Header, bodies []string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for i, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(bodies[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// assertNothingOutside fails when the extraction wrote anything next to dest
+func assertNothingOutside(t *testing.T, dest string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(dest) {
+			t.Errorf("extraction wrote %s outside the destination", entry.Name())
+		}
+	}
+}
+
+func TestUnzipDir(t *testing.T) {
+	zipFile := writeZip(t, []zipEntry{
+		{"Players/", os.ModeDir | 0755, ""},
+		{"Level.sav", 0777, "level"},
+		{"Players/0001.sav", 0644, "player"},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := UnzipDir(zipFile, dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "Players", "0001.sav"))
+	if err != nil || string(data) != "player" {
+		t.Fatalf("Players/0001.sav = %q, %v", data, err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "Level.sav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		t.Errorf("Level.sav is group or world writable: %s", info.Mode())
+	}
+}
+
+func TestUnzipDirRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []zipEntry
+	}{
+		{"parent traversal", []zipEntry{{"../evil.sav", 0644, "evil"}}},
+		{"nested traversal", []zipEntry{{"Players/../../evil.sav", 0644, "evil"}}},
+		{"absolute name", []zipEntry{{"/tmp/evil.sav", 0644, "evil"}}},
+		{"backslash traversal", []zipEntry{{"..\\evil.sav", 0644, "evil"}}},
+		{"drive letter", []zipEntry{{"C:\\evil.sav", 0644, "evil"}}},
+		{"symlink", []zipEntry{{"Level.sav", os.ModeSymlink | 0777, "/etc/passwd"}}},
+		{"symlink directory", []zipEntry{
+			{"Players", os.ModeSymlink | 0777, ".."},
+			{"Players/evil.sav", 0644, "evil"},
+		}},
+	}
+	for _, tt := range tests {
+		dest := filepath.Join(t.TempDir(), "dest")
+		err := UnzipDir(writeZip(t, tt.entries), dest)
+		if !errors.Is(err, ErrUnsafeArchive) {
+			t.Errorf("%s: got error %v, want ErrUnsafeArchive", tt.name, err)
+		}
+		assertNothingOutside(t, dest)
+	}
+}
+
+func TestUnTarGzDirRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header *tar.Header
+		body   string
+	}{
+		{"parent traversal", &tar.Header{Typeflag: tar.TypeReg, Name: "../evil.sav", Mode: 0644, Size: 4}, "evil"},
+		{"absolute name", &tar.Header{Typeflag: tar.TypeReg, Name: "/tmp/evil.sav", Mode: 0644, Size: 4}, "evil"},
+		{"drive letter", &tar.Header{Typeflag: tar.TypeReg, Name: "C:/evil.sav", Mode: 0644, Size: 4}, "evil"},
+		{"symlink", &tar.Header{Typeflag: tar.TypeSymlink, Name: "Level.sav", Linkname: "/etc/passwd", Mode: 0777}, ""},
+		{"hardlink", &tar.Header{Typeflag: tar.TypeLink, Name: "Level.sav", Linkname: "/etc/passwd", Mode: 0644}, ""},
+	}
+	for _, tt := range tests {
+		dest := filepath.Join(t.TempDir(), "dest")
+		err := UnTarGzDir(writeTarGz(t, []*tar.Header{tt.header}, []string{tt.body}), dest)
+		if !errors.Is(err, ErrUnsafeArchive) {
+			t.Errorf("%s: got error %v, want ErrUnsafeArchive", tt.name, err)
+		}
+		assertNothingOutside(t, dest)
+	}
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "Players/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "Players/0001.sav", Mode: 0644, Size: 6},
+	}
+	if err := UnTarGzDir(writeTarGz(t, headers, []string{"", "player"}), dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "Players", "0001.sav")); err != nil || string(data) != "player" {
+		t.Fatalf("Players/0001.sav = %q, %v", data, err)
+	}
+}
+
+func TestExtractorLimits(t *testing.T) {
+	type file struct {
+		name string
+		body string
+		size int64 // claimed by the archive
+	}
+	tests := []struct {
+		name    string
+		limits  ExtractLimits
+		files   []file
+		wantErr bool
+	}{
+		{"within limits", ExtractLimits{MaxFiles: 2, MaxFileSize: 10, MaxTotalSize: 20},
+			[]file{{"a.sav", "0123456789", 10}, {"b.sav", "0123456789", 10}}, false},
+		{"no limits", ExtractLimits{},
+			[]file{{"a.sav", strings.Repeat("x", 1<<16), -1}}, false},
+		{"too many files", ExtractLimits{MaxFiles: 2},
+			[]file{{"a.sav", "a", 1}, {"b.sav", "b", 1}, {"c.sav", "c", 1}}, true},
+		{"claimed file size", ExtractLimits{MaxFileSize: 10},
+			[]file{{"a.sav", "01234567890", 11}}, true},
+		{"actual file size", ExtractLimits{MaxFileSize: 10},
+			[]file{{"a.sav", "01234567890", 5}}, true},
+		{"unknown file size", ExtractLimits{MaxFileSize: 10},
+			[]file{{"a.sav", "01234567890", -1}}, true},
+		{"total size", ExtractLimits{MaxTotalSize: 15},
+			[]file{{"a.sav", "0123456789", 10}, {"b.sav", "0123456789", 10}}, true},
+		{"total size without claims", ExtractLimits{MaxTotalSize: 15},
+			[]file{{"a.sav", "0123456789", -1}, {"b.sav", "0123456789", -1}}, true},
+	}
+	for _, tt := range tests {
+		extractor := NewExtractor(filepath.Join(t.TempDir(), "dest"))
+		extractor.Limits = tt.limits
+		var err error
+		for _, f := range tt.files {
+			if err = extractor.WriteFile(f.name, strings.NewReader(f.body), f.size, 0644); err != nil {
+				break
+			}
+		}
+		if tt.wantErr && !errors.Is(err, ErrUnsafeArchive) {
+			t.Errorf("%s: got error %v, want ErrUnsafeArchive", tt.name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestUnzipDirLimits(t *testing.T) {
+	// a highly compressible entry stands in for a zip bomb
+	zipFile := writeZip(t, []zipEntry{{"Level.sav", 0644, strings.Repeat("0", 1<<20)}})
+	saved := DefaultExtractLimits
+	DefaultExtractLimits = ExtractLimits{MaxFiles: 10, MaxFileSize: 1 << 10, MaxTotalSize: 1 << 10}
+	defer func() { DefaultExtractLimits = saved }()
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := UnzipDir(zipFile, dest); !errors.Is(err, ErrUnsafeArchive) {
+		t.Fatalf("got error %v, want ErrUnsafeArchive", err)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -119,6 +122,8 @@ func ZipDir(srcDir, zipFilePath string) error {
 	return err
 }
 
+// UnzipDir extracts zipFile below destDir within DefaultExtractLimits, links and
+// entries leaving destDir are rejected
 func UnzipDir(zipFile, destDir string) error {
 	reader, err := zip.OpenReader(zipFile)
 	if err != nil {
@@ -126,38 +131,37 @@ func UnzipDir(zipFile, destDir string) error {
 	}
 	defer reader.Close()
 
+	extractor := NewExtractor(destDir)
 	for _, file := range reader.File {
-		path := filepath.Join(destDir, file.Name)
-
-		if file.FileInfo().IsDir() {
-			if err := os.MkdirAll(path, file.Mode()); err != nil {
-				return err
-			}
-		} else {
-			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-				return err
-			}
-
-			outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-			if err != nil {
-				return err
-			}
-			defer outFile.Close()
-
-			rc, err := file.Open()
-			if err != nil {
-				return err
-			}
-			defer rc.Close()
-
-			if _, err := io.Copy(outFile, rc); err != nil {
-				return err
-			}
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			err = extractor.Mkdir(file.Name)
+		case mode.IsRegular():
+			err = unzipFile(extractor, file)
+		default:
+			err = fmt.Errorf("%w: %s is not a regular file", ErrUnsafeArchive, file.Name)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func unzipFile(extractor *Extractor, file *zip.File) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	size := int64(file.UncompressedSize64)
+	if size < 0 {
+		size = -1
+	}
+	return extractor.WriteFile(file.Name, rc, size, file.Mode())
+}
+
 func CleanAndCreateDir(dirPath string) error {
 	if _, err := os.Stat(dirPath); !os.IsNotExist(err) {
 		if err := os.RemoveAll(dirPath); err != nil {
@@ -213,6 +217,54 @@ func GetLevelSavFilePath(path string) (string, error) {
 	return foundPath, nil
 }
 
+// LatestSavModTime returns the newest modification time among the .sav files
+// in savDir and savDir/Players
+func LatestSavModTime(savDir string) (time.Time, error) {
+	var latest time.Time
+	names, err := ListSavFiles(savDir)
+	if err != nil {
+		return latest, err
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(savDir, filepath.FromSlash(name)))
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// WaitForSavSettle waits until the .sav files in savDir have been written after `since`
+// and then stayed unchanged for `quiet`, giving up after `timeout`
+func WaitForSavSettle(savDir string, since time.Time, quiet, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var last time.Time
+	stableSince := time.Now()
+	for {
+		latest, err := LatestSavModTime(savDir)
+		if err != nil {
+			return err
+		}
+		if !latest.Equal(last) {
+			last = latest
+			stableSince = time.Now()
+		}
+		if !last.Before(since) && time.Since(stableSince) >= quiet {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if last.Before(since) {
+				return errors.New("save files were not written after the save request")
+			}
+			return errors.New("save files did not settle in time")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 // LimitCacheZipFiles keeps only the latest `n` zip archives in the cache directory
 func LimitCacheZipFiles(cacheDir string, n int) {
 	files, err := os.ReadDir(cacheDir)
@@ -287,6 +339,8 @@ func LimitCacheDir(cacheDirPrefix string, n int) error {
 	return nil
 }
 
+// UnTarGzDir extracts a tar.gz stream below destDir within DefaultExtractLimits,
+// links and entries leaving destDir are rejected
 func UnTarGzDir(tarStream io.Reader, destDir string) error {
 	gzr, err := gzip.NewReader(tarStream)
 	if err != nil {
@@ -295,10 +349,9 @@ func UnTarGzDir(tarStream io.Reader, destDir string) error {
 	defer gzr.Close()
 
 	tr := tar.NewReader(gzr)
-
+	extractor := NewExtractor(destDir)
 	for {
 		header, err := tr.Next()
-
 		if err == io.EOF {
 			break
 		}
@@ -306,29 +359,119 @@ func UnTarGzDir(tarStream io.Reader, destDir string) error {
 			return err
 		}
 
-		target := filepath.Join(destDir, header.Name)
-
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.ModePerm); err != nil {
-				return err
-			}
+			err = extractor.Mkdir(header.Name)
 		case tar.TypeReg:
-			targetDir := filepath.Dir(target)
-			if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
-				return err
-			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+			err = extractor.WriteFile(header.Name, tr, header.Size, header.FileInfo().Mode())
+		case tar.TypeSymlink, tar.TypeLink:
+			err = fmt.Errorf("%w: %s is a link", ErrUnsafeArchive, header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TarSavDir writes the .sav files of srcDir and srcDir/Players to w as a tar stream,
+// owned by uid/gid when ownership is requested
+func TarSavDir(srcDir string, w io.Writer, gz bool, uid, gid int) error {
+	var out io.Writer = w
+	if gz {
+		gzw := gzip.NewWriter(w)
+		defer gzw.Close()
+		out = gzw
+	}
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	files, err := ListSavFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	wroteDir := false
+	for _, name := range files {
+		if strings.HasPrefix(name, "Players/") && !wroteDir {
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     "Players/",
+				Mode:     0755,
+				Uid:      uid,
+				Gid:      gid,
+				ModTime:  time.Now(),
+			})
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(f, tr); err != nil {
-				f.Close()
-				return err
+			wroteDir = true
+		}
+		if err = addFileToTar(tw, filepath.Join(srcDir, filepath.FromSlash(name)), name, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, path, name string, uid, gid int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Uid = uid
+	header.Gid = gid
+	header.Uname = ""
+	header.Gname = ""
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// ListSavFiles returns the slash separated names of the .sav files in savDir and savDir/Players
+func ListSavFiles(savDir string) ([]string, error) {
+	var names []string
+	for _, pattern := range []string{"*.sav", "Players/*.sav"} {
+		files, err := filepath.Glob(filepath.Join(savDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			rel, err := filepath.Rel(savDir, file)
+			if err != nil {
+				return nil, err
 			}
-			f.Close()
+			names = append(names, filepath.ToSlash(rel))
 		}
 	}
+	return names, nil
+}
+
+// Sha256File returns the size and hex encoded sha256 of a file
+func Sha256File(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
 
-	return nil
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
 }
@@ -0,0 +1,21 @@
+//go:build linux
+
+package system
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// LimitMemory makes cmd run with its address space limited to limit bytes. The limit is
+// set by a shell right before the exec, so processes forked by cmd inherit it as well.
+func LimitMemory(cmd *exec.Cmd, limit int64) error {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return fmt.Errorf("sh is needed for the memory limit: %s", err)
+	}
+	script := fmt.Sprintf(`ulimit -v %d && exec "$0" "$@"`, limit>>10)
+	cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = sh
+	return nil
+}
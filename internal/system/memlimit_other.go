@@ -0,0 +1,13 @@
+//go:build !linux
+
+package system
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// LimitMemory is only supported on linux
+func LimitMemory(cmd *exec.Cmd, limit int64) error {
+	return errors.New("memory limit is only supported on linux")
+}
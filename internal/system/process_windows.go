@@ -0,0 +1,25 @@
+//go:build windows
+
+package system
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup starts cmd in a process group of its own
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// KillProcessGroup kills a command started with SetProcessGroup, processes it
+// forked are left to exit once their pipes close
+func KillProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,66 @@
+package system
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var gvasMagic = []byte("GVAS")
+
+// CheckSavHeader checks a .sav file starts like a Palworld save: a plain GVAS file,
+// or the 12 byte Palworld header with PlZ (zlib, decompressed to find GVAS) or PlM (Oodle)
+func CheckSavHeader(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("save file is empty")
+		}
+		return err
+	}
+	header = header[:n]
+	if bytes.HasPrefix(header, gvasMagic) {
+		return nil
+	}
+	if len(header) < 12 {
+		return errors.New("save file is truncated")
+	}
+
+	switch string(header[8:11]) {
+	case "PlM":
+		return nil
+	case "PlZ":
+		// 0x31 is compressed once, 0x32 twice
+		if header[11] != 0x31 && header[11] != 0x32 {
+			return fmt.Errorf("save file has unknown compression type 0x%x", header[11])
+		}
+		var r io.Reader = file
+		for i := 0; i < int(header[11]-0x30); i++ {
+			zr, err := zlib.NewReader(r)
+			if err != nil {
+				return fmt.Errorf("save file zlib stream is corrupt: %s", err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		magic := make([]byte, len(gvasMagic))
+		if _, err := io.ReadFull(r, magic); err != nil {
+			return fmt.Errorf("save file zlib stream is corrupt: %s", err)
+		}
+		if !bytes.Equal(magic, gvasMagic) {
+			return errors.New("decompressed save file has no GVAS header")
+		}
+		return nil
+	}
+	return errors.New("save file has no GVAS or Palworld header")
+}
@@ -0,0 +1,112 @@
+package task
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+)
+
+var (
+	ingestMu sync.Mutex
+	// pendingIngests holds the newest pushed save per server waiting for the running decode
+	pendingIngests = make(map[string]string)
+	// ingestingServers marks servers whose pushed saves are being decoded
+	ingestingServers = make(map[string]bool)
+)
+
+// IngestSave decodes a save unpacked by tool.UnpackIngest as a sav job of the server.
+// While pushed saves of the server are decoded or a pulled one is, the save waits and
+// replaces any save that was waiting before it, so the newest push is always decoded.
+// queued reports a waiting save, job is then the sav job running for the server.
+func IngestSave(server *config.Server, levelFilePath string) (job Job, queued bool) {
+	ingestMu.Lock()
+	if ingestingServers[server.Id] {
+		if previous, ok := pendingIngests[server.Id]; ok {
+			os.RemoveAll(filepath.Dir(previous))
+		}
+		pendingIngests[server.Id] = levelFilePath
+		ingestMu.Unlock()
+		logger.Infof("Save pushed for server %s queued behind the running decode\n", server.Id)
+		job, _ = runningJob(server.Id, JobKindSav)
+		return job, true
+	}
+	ingestingServers[server.Id] = true
+	pendingIngests[server.Id] = levelFilePath
+	ingestMu.Unlock()
+
+	job, started := StartJob(server.Id, JobKindSav, func() error {
+		return decodePendingIngests(server)
+	})
+	if !started {
+		// a pulled save is decoding, the push runs once it is done
+		go func() {
+			waitForJob(job.Id)
+			for {
+				running, started := RunJob(server.Id, JobKindSav, func() error {
+					return decodePendingIngests(server)
+				})
+				if started {
+					return
+				}
+				waitForJob(running.Id)
+			}
+		}()
+		return job, true
+	}
+	return job, false
+}
+
+// decodePendingIngests decodes the pushed saves of the server until none is waiting
+func decodePendingIngests(server *config.Server) error {
+	var lastErr error
+	for {
+		ingestMu.Lock()
+		levelFilePath, ok := pendingIngests[server.Id]
+		delete(pendingIngests, server.Id)
+		if !ok {
+			delete(ingestingServers, server.Id)
+			ingestMu.Unlock()
+			return lastErr
+		}
+		ingestMu.Unlock()
+
+		lastErr = tool.DecodeIngested(server, levelFilePath)
+		switch {
+		case errors.Is(lastErr, source.ErrNotModified):
+			logger.Infof("Save pushed for server %s unchanged, skipping decode\n", server.Id)
+		case lastErr != nil:
+			logger.Errorf("Failed to decode pushed save for server %s: %v\n", server.Id, lastErr)
+		default:
+			logger.Infof("Sav sync done for server %s\n", server.Id)
+		}
+	}
+}
+
+// runningJob returns the job of the kind running for the server
+func runningJob(serverId, kind string) (Job, bool) {
+	jobMu.Lock()
+	id, ok := runningJobs[serverId+"/"+kind]
+	jobMu.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	return GetJob(id)
+}
+
+// waitForJob returns once the job is no longer running
+func waitForJob(jobId string) {
+	for {
+		job, ok := GetJob(jobId)
+		if !ok || job.State != JobStateRunning {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,179 @@
+package task
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+)
+
+const (
+	JobKindRest   = "rest"
+	JobKindSav    = "sav"
+	JobKindBackup = "backup"
+)
+
+const (
+	JobStateRunning   = "running"
+	JobStateSuccess   = "success"
+	JobStateFailed    = "failed"
+	JobStateUnchanged = "unchanged"
+)
+
+// maxJobs is how many finished jobs are kept for the job list
+const maxJobs = 200
+
+// Job is a sync or backup run for a server
+type Job struct {
+	Id       string `json:"id"`
+	ServerId string `json:"server_id"`
+	Kind     string `json:"kind"`  // rest, sav, backup
+	State    string `json:"state"` // running, success, failed, unchanged
+	Error    string `json:"error"`
+	// Stderr is the end of the sav_cli output of a failed decode
+	Stderr    string    `json:"stderr"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// Duration is in seconds, up to now for running jobs
+	Duration float64 `json:"duration"`
+}
+
+var (
+	jobMu sync.Mutex
+	jobs  = make(map[string]*Job)
+	// runningJobs maps server and kind to the id of the running job
+	runningJobs = make(map[string]string)
+)
+
+// StartJob runs fn in the background as a job of the server. A job of the same kind
+// already running for the server is returned instead, started reports which it is.
+func StartJob(serverId, kind string, fn func() error) (job Job, started bool) {
+	running, started := beginJob(serverId, kind)
+	if started {
+		go func() {
+			finishJob(running, fn())
+		}()
+	}
+	return snapshotJob(running), started
+}
+
+// RunJob is StartJob waiting for fn to return
+func RunJob(serverId, kind string, fn func() error) (job Job, started bool) {
+	running, started := beginJob(serverId, kind)
+	if started {
+		finishJob(running, fn())
+	}
+	return snapshotJob(running), started
+}
+
+func beginJob(serverId, kind string) (*Job, bool) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	key := serverId + "/" + kind
+	if id, ok := runningJobs[key]; ok {
+		logger.Infof("A %s job is already running for server %s, joining job %s\n", kind, serverId, id)
+		return jobs[id], false
+	}
+	job := &Job{
+		Id:        uuid.New().String(),
+		ServerId:  serverId,
+		Kind:      kind,
+		State:     JobStateRunning,
+		StartTime: time.Now(),
+	}
+	jobs[job.Id] = job
+	runningJobs[key] = job.Id
+	pruneJobs()
+	return job, true
+}
+
+func finishJob(job *Job, err error) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	job.EndTime = time.Now()
+	switch {
+	case err == nil:
+		job.State = JobStateSuccess
+	case errors.Is(err, source.ErrNotModified):
+		job.State = JobStateUnchanged
+	default:
+		job.State = JobStateFailed
+		job.Error = err.Error()
+		var decodeErr *tool.DecodeError
+		if errors.As(err, &decodeErr) {
+			job.Stderr = decodeErr.Stderr
+		}
+	}
+	delete(runningJobs, job.ServerId+"/"+job.Kind)
+}
+
+// pruneJobs drops the oldest finished jobs beyond maxJobs, jobMu must be held
+func pruneJobs() {
+	if len(jobs) <= maxJobs {
+		return
+	}
+	finished := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.State != JobStateRunning {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartTime.Before(finished[j].StartTime)
+	})
+	for i := 0; i < len(jobs)-maxJobs && i < len(finished); i++ {
+		delete(jobs, finished[i].Id)
+	}
+}
+
+func snapshotJob(job *Job) Job {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	snapshot := *job
+	end := snapshot.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	snapshot.Duration = end.Sub(snapshot.StartTime).Seconds()
+	return snapshot
+}
+
+// GetJob returns a snapshot of a job
+func GetJob(jobId string) (Job, bool) {
+	jobMu.Lock()
+	job, ok := jobs[jobId]
+	jobMu.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	return snapshotJob(job), true
+}
+
+// ListJobs returns the newest jobs first, optionally only those of a server or kind
+func ListJobs(serverId, kind string, limit int) []Job {
+	jobMu.Lock()
+	matched := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if (serverId == "" || job.ServerId == serverId) && (kind == "" || job.Kind == kind) {
+			matched = append(matched, job)
+		}
+	}
+	jobMu.Unlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].StartTime.After(matched[j].StartTime)
+	})
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+	list := make([]Job, 0, len(matched))
+	for _, job := range matched {
+		list = append(list, snapshotJob(job))
+	}
+	return list
+}
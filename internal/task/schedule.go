@@ -0,0 +1,446 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/spf13/viper"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
+	"github.com/zaigie/palworld-server-tool/service"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	TaskKindPlayerSync   = "player_sync"
+	TaskKindSavSync      = "sav_sync"
+	TaskKindBackup       = "backup"
+	TaskKindBackupVerify = "backup_verify"
+	TaskKindCacheCleanup = "cache_cleanup"
+)
+
+// TaskResultSkipped is the result of a run that joined a sync or backup job already running
+const TaskResultSkipped = "skipped"
+
+// cacheCleanupInterval is how often in seconds old decoded saves are removed from the temp dir
+const cacheCleanupInterval = 300
+
+var ErrTaskNotFound = errors.New("task not found")
+
+var errTaskSkipped = errors.New("job already running")
+
+// TaskInfo is a scheduled task with its schedule and the result of its last run
+type TaskInfo struct {
+	// Name is <kind>:<server_id>, or the kind alone for tasks not bound to a server
+	Name     string `json:"name"`
+	ServerId string `json:"server_id"`
+	Kind     string `json:"kind"` // player_sync, sav_sync, backup, backup_verify, cache_cleanup
+	// Interval is the effective interval in seconds, 0 when the task is disabled
+	Interval int `json:"interval"`
+	// ConfiguredInterval is the interval from the config, Interval differs when overridden
+	ConfiguredInterval int       `json:"configured_interval"`
+	Paused             bool      `json:"paused"`
+	NextRun            time.Time `json:"next_run"`
+	LastRun            time.Time `json:"last_run"`
+	LastResult         string    `json:"last_result"` // success, failed, unchanged, skipped
+	LastError          string    `json:"last_error"`
+	// LastDuration is in seconds
+	LastDuration float64 `json:"last_duration"`
+}
+
+type scheduledTask struct {
+	name     string
+	serverId string
+	kind     string
+	run      func() error
+	// interval is what the task is scheduled with, 0 when it is not
+	interval int
+	job      gocron.Job
+}
+
+var (
+	s      gocron.Scheduler
+	taskMu sync.Mutex
+	tasks  = make(map[string]*scheduledTask)
+	taskDb *bbolt.DB
+)
+
+// Schedule starts the scheduler with a task per kind and enabled server, paused tasks
+// and interval overrides are restored from the database
+func Schedule(db *bbolt.DB) {
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		logger.Errorf("%v\n", err)
+		return
+	}
+	taskMu.Lock()
+	s = scheduler
+	taskDb = db
+	taskMu.Unlock()
+
+	RefreshTasks()
+	scheduler.Start()
+}
+
+func Shutdown() {
+	taskMu.Lock()
+	scheduler := s
+	taskMu.Unlock()
+	if scheduler == nil {
+		return
+	}
+	err := scheduler.Shutdown()
+	if err != nil {
+		logger.Errorf("%v\n", err)
+	}
+}
+
+// RefreshTasks adds the tasks of new servers, removes those of deleted or disabled ones
+// and reschedules tasks whose configured interval changed
+func RefreshTasks() {
+	taskMu.Lock()
+	defer taskMu.Unlock()
+	if s == nil {
+		return
+	}
+
+	wanted := map[string]*scheduledTask{}
+	add := func(serverId, kind string, run func() error) {
+		name := kind
+		if serverId != "" {
+			name = kind + ":" + serverId
+		}
+		wanted[name] = &scheduledTask{name: name, serverId: serverId, kind: kind, run: run}
+	}
+	for _, server := range config.GetEnabledServers() {
+		add(server.Id, TaskKindPlayerSync, serverTask(server.Id, "", func(server *config.Server) error {
+			return syncPlayersByServer(taskDb, server)
+		}))
+		if server.Save.Path == "" {
+			logger.Warnf("Save path not configured for server %s, skipping save tasks\n", server.Id)
+			continue
+		}
+		add(server.Id, TaskKindSavSync, serverTask(server.Id, JobKindSav, func(server *config.Server) error {
+			return syncSavByServer(server, false)
+		}))
+		add(server.Id, TaskKindBackup, serverTask(server.Id, JobKindBackup, func(server *config.Server) error {
+			return backupServer(taskDb, server)
+		}))
+		add(server.Id, TaskKindBackupVerify, serverTask(server.Id, "", func(server *config.Server) error {
+			return verifyBackupsByServer(taskDb, server)
+		}))
+	}
+	add("", TaskKindCacheCleanup, func() error {
+		return system.LimitCacheDir(filepath.Join(os.TempDir(), "palworldsav-"), 5)
+	})
+
+	for name, t := range tasks {
+		if _, ok := wanted[name]; !ok {
+			t.unschedule()
+			delete(tasks, name)
+		}
+	}
+	for name, t := range wanted {
+		existing, ok := tasks[name]
+		if ok {
+			// keep the running schedule unless the interval changed
+			existing.run = t.run
+			t = existing
+		} else {
+			tasks[name] = t
+		}
+		state, err := service.GetTaskState(taskDb, name)
+		if err != nil {
+			logger.Errorf("Failed to load state of task %s: %v\n", name, err)
+		}
+		// new tasks run right away like at startup, except the backup verification
+		// which would re-read every backup on each restart
+		t.reschedule(state, !ok && t.kind != TaskKindBackupVerify && t.kind != TaskKindCacheCleanup)
+	}
+}
+
+// serverTask runs fn with the current config of the server, recording it as a job of
+// jobKind unless empty
+func serverTask(serverId, jobKind string, fn func(server *config.Server) error) func() error {
+	return func() error {
+		server, exists := config.GetServer(serverId)
+		if !exists {
+			return fmt.Errorf("server %s not found", serverId)
+		}
+		if jobKind == "" {
+			return fn(server)
+		}
+		var err error
+		_, started := RunJob(serverId, jobKind, func() error {
+			err = fn(server)
+			return err
+		})
+		if !started {
+			return errTaskSkipped
+		}
+		return err
+	}
+}
+
+func verifyBackupsByServer(db *bbolt.DB, server *config.Server) error {
+	err := tool.VerifyBackupsByServer(db, server)
+	if err != nil {
+		logger.Errorf("Backup verification failed for server %s: %v\n", server.Id, err)
+		return err
+	}
+	logger.Infof("Backup verification done for server %s\n", server.Id)
+	return nil
+}
+
+// configuredInterval is the interval of the task from the config, the server setting
+// when set, the global one otherwise
+func (t *scheduledTask) configuredInterval() int {
+	server, _ := config.GetServer(t.serverId)
+	serverInterval := 0
+	switch t.kind {
+	case TaskKindPlayerSync:
+		return viper.GetInt("task.sync_interval")
+	case TaskKindSavSync:
+		if server != nil {
+			serverInterval = server.Save.SyncInterval
+		}
+		return intervalOr(serverInterval, "save.sync_interval")
+	case TaskKindBackup:
+		if server != nil {
+			serverInterval = server.Save.BackupInterval
+		}
+		return intervalOr(serverInterval, "save.backup_interval")
+	case TaskKindBackupVerify:
+		if server != nil {
+			serverInterval = server.Save.BackupVerifyInterval
+		}
+		return intervalOr(serverInterval, "save.backup_verify_interval")
+	case TaskKindCacheCleanup:
+		return cacheCleanupInterval
+	}
+	return 0
+}
+
+func intervalOr(interval int, key string) int {
+	if interval > 0 {
+		return interval
+	}
+	return viper.GetInt(key)
+}
+
+// reschedule brings the gocron job in line with the task state, taskMu must be held.
+// immediately runs a task that was not scheduled yet right away.
+func (t *scheduledTask) reschedule(state database.TaskState, immediately bool) {
+	interval := t.configuredInterval()
+	if state.Interval > 0 {
+		interval = state.Interval
+	}
+	if state.Paused {
+		interval = 0
+	}
+	if t.job != nil && interval == t.interval {
+		return
+	}
+	immediately = immediately && t.job == nil
+	t.unschedule()
+	if interval <= 0 {
+		return
+	}
+
+	options := []gocron.JobOption{
+		gocron.WithName(t.name),
+		gocron.WithTags(t.kind),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	}
+	if immediately {
+		options = append(options, gocron.WithStartAt(gocron.WithStartImmediately()))
+	}
+	job, err := s.NewJob(
+		gocron.DurationJob(time.Duration(interval)*time.Second),
+		gocron.NewTask(runTask, t.name),
+		options...,
+	)
+	if err != nil {
+		logger.Errorf("Failed to schedule task %s: %v\n", t.name, err)
+		return
+	}
+	t.job = job
+	t.interval = interval
+}
+
+// unschedule removes the gocron job of the task, taskMu must be held
+func (t *scheduledTask) unschedule() {
+	if t.job != nil {
+		if err := s.RemoveJob(t.job.ID()); err != nil {
+			logger.Warnf("Failed to remove task %s: %v\n", t.name, err)
+		}
+	}
+	t.job = nil
+	t.interval = 0
+}
+
+// runTask runs a task and records the result of the run
+func runTask(name string) {
+	taskMu.Lock()
+	t, ok := tasks[name]
+	var run func() error
+	if ok {
+		run = t.run
+	}
+	taskMu.Unlock()
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	err := run()
+	result := JobStateSuccess
+	switch {
+	case err == nil:
+	case errors.Is(err, source.ErrNotModified):
+		result = JobStateUnchanged
+		err = nil
+	case errors.Is(err, errTaskSkipped):
+		result = TaskResultSkipped
+		err = nil
+	default:
+		result = JobStateFailed
+	}
+	_, stateErr := service.UpdateTaskState(taskDb, name, func(state *database.TaskState) {
+		state.LastRun = start
+		state.LastResult = result
+		state.LastError = ""
+		if err != nil {
+			state.LastError = err.Error()
+		}
+		state.LastDuration = time.Since(start).Seconds()
+	})
+	if stateErr != nil {
+		logger.Errorf("Failed to save result of task %s: %v\n", name, stateErr)
+	}
+}
+
+// ListTasks returns the scheduled tasks ordered by name
+func ListTasks() []TaskInfo {
+	taskMu.Lock()
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	taskMu.Unlock()
+	sort.Strings(names)
+
+	list := make([]TaskInfo, 0, len(names))
+	for _, name := range names {
+		if info, err := GetTask(name); err == nil {
+			list = append(list, info)
+		}
+	}
+	return list
+}
+
+// GetTask returns a scheduled task
+func GetTask(name string) (TaskInfo, error) {
+	taskMu.Lock()
+	defer taskMu.Unlock()
+	t, ok := tasks[name]
+	if !ok {
+		return TaskInfo{}, ErrTaskNotFound
+	}
+	state, err := service.GetTaskState(taskDb, name)
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	info := TaskInfo{
+		Name:               t.name,
+		ServerId:           t.serverId,
+		Kind:               t.kind,
+		Interval:           t.configuredInterval(),
+		ConfiguredInterval: t.configuredInterval(),
+		Paused:             state.Paused,
+		LastRun:            state.LastRun,
+		LastResult:         state.LastResult,
+		LastError:          state.LastError,
+		LastDuration:       state.LastDuration,
+	}
+	if state.Interval > 0 {
+		info.Interval = state.Interval
+	}
+	if t.job != nil {
+		info.NextRun, _ = t.job.NextRun()
+	}
+	return info, nil
+}
+
+// PauseTask stops scheduling a task until it is resumed, also across restarts
+func PauseTask(name string) (TaskInfo, error) {
+	return updateTask(name, func(state *database.TaskState) {
+		state.Paused = true
+	})
+}
+
+// ResumeTask schedules a paused task again
+func ResumeTask(name string) (TaskInfo, error) {
+	return updateTask(name, func(state *database.TaskState) {
+		state.Paused = false
+	})
+}
+
+// SetTaskInterval overrides the configured interval of a task in seconds,
+// 0 goes back to the configured interval
+func SetTaskInterval(name string, interval int) (TaskInfo, error) {
+	if interval < 0 {
+		return TaskInfo{}, errors.New("interval must not be negative")
+	}
+	return updateTask(name, func(state *database.TaskState) {
+		state.Interval = interval
+	})
+}
+
+// RunTaskNow runs a task in the background, paused and disabled tasks included
+func RunTaskNow(name string) error {
+	taskMu.Lock()
+	t, ok := tasks[name]
+	var job gocron.Job
+	if ok {
+		job = t.job
+	}
+	taskMu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if job != nil {
+		return job.RunNow()
+	}
+	go runTask(name)
+	return nil
+}
+
+// updateTask persists a change to the state of a task and reschedules it
+func updateTask(name string, fn func(state *database.TaskState)) (TaskInfo, error) {
+	taskMu.Lock()
+	t, ok := tasks[name]
+	if !ok {
+		taskMu.Unlock()
+		return TaskInfo{}, ErrTaskNotFound
+	}
+	state, err := service.UpdateTaskState(taskDb, name, fn)
+	if err == nil {
+		t.reschedule(state, false)
+	}
+	taskMu.Unlock()
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	return GetTask(name)
+}
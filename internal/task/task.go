@@ -1,96 +1,69 @@
 package task
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/zaigie/palworld-server-tool/internal/config"
 	"github.com/zaigie/palworld-server-tool/internal/database"
-	"github.com/zaigie/palworld-server-tool/internal/system"
 
-	"github.com/go-co-op/gocron/v2"
 	"github.com/spf13/viper"
 	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
 	"github.com/zaigie/palworld-server-tool/internal/tool"
 	"github.com/zaigie/palworld-server-tool/service"
 	"go.etcd.io/bbolt"
 )
 
-var s gocron.Scheduler
+// backupServer creates a scheduled backup of the server and cleans up old ones
+func backupServer(db *bbolt.DB, server *config.Server) error {
+	logger.Infof("Backing up server %s (%s)...\n", server.Name, server.Id)
 
-func BackupTask(db *bbolt.DB) {
-	logger.Info("Scheduling backup for all servers...\n")
-
-	servers := config.GetEnabledServers()
-	for _, server := range servers {
-		logger.Infof("Backing up server %s (%s)...\n", server.Name, server.Id)
-
-		path, err := tool.BackupWithConfig(&server)
-		if err != nil {
-			logger.Errorf("Backup failed for server %s: %v\n", server.Id, err)
-			continue
-		}
-
-		err = service.AddBackupByServer(db, server.Id, database.Backup{
-			ServerId: server.Id,
-			BackupId: uuid.New().String(),
-			Path:     path,
-			SaveTime: time.Now(),
-		})
-		if err != nil {
-			logger.Errorf("Failed to save backup record for server %s: %v\n", server.Id, err)
-			continue
-		}
+	backup, err := tool.NewBackupWithConfig(db, server, tool.BackupOptions{Trigger: database.BackupTriggerScheduled})
+	if err != nil {
+		logger.Errorf("Backup failed for server %s: %v\n", server.Id, err)
+		return err
+	}
 
-		logger.Infof("Auto backup for server %s to %s\n", server.Id, path)
+	logger.Infof("Auto backup for server %s to %s\n", server.Id, backup.Path)
 
-		keepDays := server.Save.BackupKeepDays
-		if keepDays == 0 {
-			keepDays = 7
-		}
-		err = tool.CleanOldBackupsByServer(db, server.Id, keepDays)
-		if err != nil {
-			logger.Errorf("Failed to clean old backups for server %s: %v\n", server.Id, err)
-		}
+	err = tool.CleanOldBackupsByServer(db, server)
+	if err != nil {
+		logger.Errorf("Failed to clean old backups for server %s: %v\n", server.Id, err)
 	}
+	return nil
 }
 
-func PlayerSync(db *bbolt.DB) {
-	logger.Info("Scheduling Player sync for all servers...\n")
+func syncPlayersByServer(db *bbolt.DB, server *config.Server) error {
+	logger.Infof("Syncing players for server %s (%s)...\n", server.Name, server.Id)
 
-	servers := config.GetEnabledServers()
-	for _, server := range servers {
-		logger.Infof("Syncing players for server %s (%s)...\n", server.Name, server.Id)
-
-		onlinePlayers, err := tool.ShowPlayersWithConfig(&server)
-		if err != nil {
-			logger.Errorf("Failed to get online players for server %s: %v\n", server.Id, err)
-			continue
-		}
+	onlinePlayers, err := tool.ShowPlayersWithConfig(server)
+	if err != nil {
+		logger.Errorf("Failed to get online players for server %s: %v\n", server.Id, err)
+		return err
+	}
 
-		err = service.PutPlayersOnlineByServer(db, server.Id, onlinePlayers)
-		if err != nil {
-			logger.Errorf("Failed to save online players for server %s: %v\n", server.Id, err)
-			continue
-		}
+	err = service.PutPlayersOnlineByServer(db, server.Id, onlinePlayers)
+	if err != nil {
+		logger.Errorf("Failed to save online players for server %s: %v\n", server.Id, err)
+		return err
+	}
 
-		logger.Infof("Player sync done for server %s\n", server.Id)
+	logger.Infof("Player sync done for server %s\n", server.Id)
 
-		playerLogging := viper.GetBool("task.player_logging")
-		if playerLogging {
-			go PlayerLoggingByServer(&server, onlinePlayers)
-		}
+	playerLogging := viper.GetBool("task.player_logging")
+	if playerLogging {
+		go PlayerLoggingByServer(server, onlinePlayers)
+	}
 
-		kickInterval := viper.GetBool("manage.kick_non_whitelist")
-		if kickInterval {
-			go CheckAndKickPlayersByServer(db, &server, onlinePlayers)
-		}
+	kickInterval := viper.GetBool("manage.kick_non_whitelist")
+	if kickInterval {
+		go CheckAndKickPlayersByServer(db, server, onlinePlayers)
 	}
+	return nil
 }
 
 func isPlayerWhitelisted(player database.OnlinePlayer, whitelist []database.PlayerW) bool {
@@ -201,157 +174,50 @@ func CheckAndKickPlayersByServer(db *bbolt.DB, server *config.Server, players []
 	logger.Infof("Check whitelist done for server %s\n", server.Id)
 }
 
-func SavSync() {
-	logger.Info("Scheduling Sav sync for all servers...\n")
-
-	servers := config.GetEnabledServers()
-	for _, server := range servers {
-		if server.Save.Path == "" {
-			logger.Warnf("Save path not configured for server %s, skipping\n", server.Id)
-			continue
-		}
-
-		logger.Infof("Syncing save for server %s (%s)...\n", server.Name, server.Id)
-
-		err := tool.DecodeWithConfig(&server, server.Save.Path)
-		if err != nil {
-			logger.Errorf("Failed to decode save for server %s: %v\n", server.Id, err)
-			continue
-		}
-
-		logger.Infof("Sav sync done for server %s\n", server.Id)
-	}
-}
-
-func Schedule(db *bbolt.DB) {
-	s := getScheduler()
-
-	playerSyncInterval := time.Duration(viper.GetInt("task.sync_interval"))
-	savSyncInterval := time.Duration(viper.GetInt("save.sync_interval"))
-	backupInterval := time.Duration(viper.GetInt("save.backup_interval"))
-
-	if playerSyncInterval > 0 {
-		go PlayerSync(db)
-		_, err := s.NewJob(
-			gocron.DurationJob(playerSyncInterval*time.Second),
-			gocron.NewTask(PlayerSync, db),
-		)
-		if err != nil {
-			logger.Errorf("%v\n", err)
-		}
-	}
-
-	if savSyncInterval > 0 {
-		go SavSync()
-		_, err := s.NewJob(
-			gocron.DurationJob(savSyncInterval*time.Second),
-			gocron.NewTask(SavSync),
-		)
-		if err != nil {
-			logger.Errorf("%v\n", err)
-		}
-	}
-
-	if backupInterval > 0 {
-		go BackupTask(db)
-		_, err := s.NewJob(
-			gocron.DurationJob(backupInterval*time.Second),
-			gocron.NewTask(BackupTask, db),
-		)
-		if err != nil {
-			logger.Error(err)
-		}
-	}
-
-	_, err := s.NewJob(
-		gocron.DurationJob(300*time.Second),
-		gocron.NewTask(system.LimitCacheDir, filepath.Join(os.TempDir(), "palworldsav-"), 5),
-	)
-	if err != nil {
-		logger.Errorf("%v\n", err)
+// syncSavByServer decodes the save of the server, source.ErrNotModified is returned
+// for a save unchanged since the last decode unless force is set
+func syncSavByServer(server *config.Server, force bool) error {
+	if server.Save.Path == "" {
+		logger.Warnf("Save path not configured for server %s, skipping\n", server.Id)
+		return errors.New("save path not configured for server")
 	}
 
-	s.Start()
-}
+	logger.Infof("Syncing save for server %s (%s)...\n", server.Name, server.Id)
 
-func Shutdown() {
-	s := getScheduler()
-	err := s.Shutdown()
-	if err != nil {
-		logger.Errorf("%v\n", err)
+	err := tool.DecodeWithConfig(server, server.Save.Path, force)
+	if errors.Is(err, source.ErrNotModified) {
+		logger.Infof("Save of server %s unchanged, skipping decode\n", server.Id)
+		return err
 	}
-}
-
-func initScheduler() gocron.Scheduler {
-	s, err := gocron.NewScheduler()
 	if err != nil {
-		logger.Errorf("%v\n", err)
+		logger.Errorf("Failed to decode save for server %s: %v\n", server.Id, err)
+		return err
 	}
-	return s
-}
 
-func getScheduler() gocron.Scheduler {
-	if s == nil {
-		return initScheduler()
-	}
-	return s
+	logger.Infof("Sav sync done for server %s\n", server.Id)
+	return nil
 }
 
-// PlayerSyncByServer synchronizes player data for a specific server
-func PlayerSyncByServer(db *bbolt.DB, serverId string) {
-	logger.Infof("Syncing players for server %s...\n", serverId)
-
-	server, exists := config.GetServer(serverId)
-	if !exists {
-		logger.Errorf("Server %s not found\n", serverId)
-		return
-	}
-
-	onlinePlayers, err := tool.ShowPlayersWithConfig(server)
-	if err != nil {
-		logger.Errorf("Failed to get online players for server %s: %v\n", serverId, err)
-		return
-	}
-
-	err = service.PutPlayersOnlineByServer(db, serverId, onlinePlayers)
-	if err != nil {
-		logger.Errorf("Failed to save online players for server %s: %v\n", serverId, err)
-		return
-	}
-
-	logger.Infof("Player sync done for server %s\n", serverId)
-
-	playerLogging := viper.GetBool("task.player_logging")
-	if playerLogging {
-		go PlayerLoggingByServer(server, onlinePlayers)
-	}
-
-	kickInterval := viper.GetBool("manage.kick_non_whitelist")
-	if kickInterval {
-		go CheckAndKickPlayersByServer(db, server, onlinePlayers)
-	}
+// PlayerSyncByServer starts a player sync job for a specific server, or returns the
+// one already running
+func PlayerSyncByServer(db *bbolt.DB, serverId string) (Job, bool) {
+	return StartJob(serverId, JobKindRest, func() error {
+		server, exists := config.GetServer(serverId)
+		if !exists {
+			return fmt.Errorf("server %s not found", serverId)
+		}
+		return syncPlayersByServer(db, server)
+	})
 }
 
-// SavSyncByServer synchronizes save data for a specific server
-func SavSyncByServer(serverId string) {
-	logger.Infof("Syncing save for server %s...\n", serverId)
-
-	server, exists := config.GetServer(serverId)
-	if !exists {
-		logger.Errorf("Server %s not found\n", serverId)
-		return
-	}
-
-	if server.Save.Path == "" {
-		logger.Warnf("Save path not configured for server %s, skipping\n", serverId)
-		return
-	}
-
-	err := tool.DecodeWithConfig(server, server.Save.Path)
-	if err != nil {
-		logger.Errorf("Failed to decode save for server %s: %v\n", serverId, err)
-		return
-	}
-
-	logger.Infof("Sav sync done for server %s\n", serverId)
+// SavSyncByServer starts a save sync job for a specific server, or returns the
+// one already running. force decodes the save even when it is unchanged.
+func SavSyncByServer(serverId string, force bool) (Job, bool) {
+	return StartJob(serverId, JobKindSav, func() error {
+		server, exists := config.GetServer(serverId)
+		if !exists {
+			return fmt.Errorf("server %s not found", serverId)
+		}
+		return syncSavByServer(server, force)
+	})
 }
@@ -0,0 +1,291 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/chunkstore"
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+var (
+	chunkStoreMu sync.Mutex
+	chunkStore   *chunkstore.Store
+)
+
+// getChunkStore opens the chunk store shared by the backups of all servers,
+// so identical files of different servers are stored once too
+func getChunkStore() (*chunkstore.Store, error) {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	if chunkStore != nil {
+		return chunkStore, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	key, err := getBackupKey()
+	if err != nil {
+		return nil, err
+	}
+	store, err := chunkstore.Open(filepath.Join(wd, "backups", ".chunks"), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk store: %s", err)
+	}
+	chunkStore = store
+	return chunkStore, nil
+}
+
+func isChunkedBackup(backup *database.Backup) bool {
+	return backup.Format == database.BackupFormatChunks
+}
+
+// hasLocalBackup reports whether the archive or manifest of a backup is still on this host
+func hasLocalBackup(backup *database.Backup) bool {
+	if isChunkedBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return false
+		}
+		return store.HasManifest(backupKey(backup.ServerId, backup.Path))
+	}
+	backupFile, err := GetBackupFilePathByServer(backup.ServerId, backup.Path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(backupFile)
+	return err == nil
+}
+
+// removeLocalBackup removes the local archive or manifest of a backup. Chunks
+// are only freed by the next gcChunkStore.
+func removeLocalBackup(backup *database.Backup) error {
+	if isChunkedBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return err
+		}
+		return store.DeleteManifest(backupKey(backup.ServerId, backup.Path))
+	}
+	backupFile, err := GetBackupFilePathByServer(backup.ServerId, backup.Path)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(backupFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// statLocalBackup returns the size and checksum of a local backup. For chunked
+// backups these are the total size of the saved files and the manifest checksum.
+func statLocalBackup(backup *database.Backup) (int64, string, error) {
+	if isChunkedBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return 0, "", err
+		}
+		name := backupKey(backup.ServerId, backup.Path)
+		manifest, err := store.GetManifest(name)
+		if err != nil {
+			return 0, "", err
+		}
+		checksum, err := store.ManifestChecksum(name)
+		if err != nil {
+			return 0, "", err
+		}
+		return manifest.Size(), checksum, nil
+	}
+	backupFile, err := GetBackupFilePathByServer(backup.ServerId, backup.Path)
+	if err != nil {
+		return 0, "", err
+	}
+	return system.Sha256File(backupFile)
+}
+
+// fetchArchiveByServer returns a local path of the archive as stored, downloading it
+// from a backup target when the local copy is gone. Call cleanup when done.
+func fetchArchiveByServer(backup *database.Backup) (string, func(), error) {
+	backupFile, err := GetBackupFilePathByServer(backup.ServerId, backup.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = os.Stat(backupFile); err == nil {
+		return backupFile, func() {}, nil
+	}
+
+	for _, name := range backup.Targets {
+		tempFile, err := downloadFromTarget(name, backupKey(backup.ServerId, backup.Path))
+		if err != nil {
+			logger.Warnf("Failed to download backup %s from target %s: %v\n", backup.Path, name, err)
+			continue
+		}
+		return tempFile, func() { os.Remove(tempFile) }, nil
+	}
+	return "", nil, errors.New("backup file not found locally or on any backup target")
+}
+
+// exportArchiveByServer returns the backup in the form kept on backup targets: the zip
+// archive as stored, or for chunked backups a reassembled zip encrypted with key
+func exportArchiveByServer(backup *database.Backup, key *crypt.Key) (string, func(), error) {
+	if !isChunkedBackup(backup) {
+		return fetchArchiveByServer(backup)
+	}
+	plainFile, cleanup, err := FetchBackupByServer(backup)
+	if err != nil {
+		return "", nil, err
+	}
+	if key == nil {
+		return plainFile, cleanup, nil
+	}
+	defer cleanup()
+	tempFile := filepath.Join(os.TempDir(), "pst-backup-"+uuid.New().String()+".zip.enc")
+	if err = crypt.EncryptFile(plainFile, tempFile, key); err != nil {
+		return "", nil, err
+	}
+	return tempFile, func() { os.Remove(tempFile) }, nil
+}
+
+// FetchBackupByServer returns a local path of the backup as a plain zip archive. Chunked
+// backups are reassembled, encrypted ones decrypted and when the local copy is gone the
+// archive is downloaded from a backup target. Call cleanup when done.
+func FetchBackupByServer(backup *database.Backup) (string, func(), error) {
+	key, err := getBackupKey()
+	if err != nil {
+		return "", nil, err
+	}
+	return fetchBackupWithKeys(backup, key)
+}
+
+func fetchBackupWithKeys(backup *database.Backup, keys ...*crypt.Key) (string, func(), error) {
+	if isChunkedBackup(backup) && hasLocalBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return "", nil, err
+		}
+		tempFile := filepath.Join(os.TempDir(), "pst-backup-"+uuid.New().String()+".zip")
+		file, err := os.Create(tempFile)
+		if err != nil {
+			return "", nil, err
+		}
+		err = store.WriteZip(backupKey(backup.ServerId, backup.Path), file)
+		file.Close()
+		if err != nil {
+			os.Remove(tempFile)
+			return "", nil, fmt.Errorf("failed to reassemble backup: %w", err)
+		}
+		return tempFile, func() { os.Remove(tempFile) }, nil
+	}
+
+	archiveFile, cleanup, err := fetchArchiveByServer(backup)
+	if err != nil {
+		return "", nil, err
+	}
+	if !backup.Encrypted {
+		return archiveFile, cleanup, nil
+	}
+	defer cleanup()
+	plainFile, err := decryptBackupFile(archiveFile, keys...)
+	if err != nil {
+		logger.Errorf("Backup %s of server %s: %v\n", backup.Path, backup.ServerId, err)
+		return "", nil, err
+	}
+	return plainFile, func() { os.Remove(plainFile) }, nil
+}
+
+// WriteBackupByServer writes the backup to w as a plain zip archive, streaming chunked
+// and encrypted backups without a temporary copy when they are stored locally
+func WriteBackupByServer(backup *database.Backup, w io.Writer) error {
+	if isChunkedBackup(backup) && hasLocalBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return err
+		}
+		return store.WriteZip(backupKey(backup.ServerId, backup.Path), w)
+	}
+
+	archiveFile, cleanup, err := fetchArchiveByServer(backup)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	file, err := os.Open(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if backup.Encrypted {
+		key, err := getBackupKey()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return errNoBackupKey
+		}
+		// the key is checked against the header before anything is written
+		if r, err = crypt.Decrypt(file, key); err != nil {
+			logger.Errorf("Backup %s of server %s: %v\n", backup.Path, backup.ServerId, err)
+			return fmt.Errorf("failed to decrypt backup: %w", err)
+		}
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// ExtractBackupByServer writes the files of the backup below destDir
+func ExtractBackupByServer(backup *database.Backup, destDir string) error {
+	if isChunkedBackup(backup) && hasLocalBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return err
+		}
+		return store.Restore(backupKey(backup.ServerId, backup.Path), destDir)
+	}
+
+	backupFile, cleanup, err := FetchBackupByServer(backup)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return system.UnzipDir(backupFile, destDir)
+}
+
+// GCBackupStore removes the chunks no longer referenced by any backup
+func GCBackupStore() (chunkstore.GCResult, error) {
+	store, err := getChunkStore()
+	if err != nil {
+		return chunkstore.GCResult{}, err
+	}
+	return store.GC()
+}
+
+// CheckBackupStore verifies every chunk referenced by a backup is present and intact
+func CheckBackupStore() (chunkstore.CheckResult, error) {
+	store, err := getChunkStore()
+	if err != nil {
+		return chunkstore.CheckResult{}, err
+	}
+	return store.Check()
+}
+
+func gcChunkStore() {
+	result, err := GCBackupStore()
+	if err != nil {
+		logger.Errorf("Failed to collect unused backup chunks: %v\n", err)
+		return
+	}
+	if result.RemovedChunks > 0 {
+		logger.Infof("Removed %d unused backup chunks, freed %d bytes\n", result.RemovedChunks, result.FreedBytes)
+	}
+}
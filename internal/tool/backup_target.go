@@ -0,0 +1,128 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/storage"
+)
+
+func backupKey(serverId, path string) string {
+	return serverId + "/" + path
+}
+
+// uploadBackupWithConfig copies a backup archive to the server's backup targets
+// and returns the names of the targets that now hold it
+func uploadBackupWithConfig(server *config.Server, backup *database.Backup, key *crypt.Key) []string {
+	targets := config.GetBackupTargets(server)
+	if len(targets) == 0 {
+		return nil
+	}
+	backupFile, cleanup, err := exportArchiveByServer(backup, key)
+	if err != nil {
+		logger.Errorf("Failed to get backup file for server %s: %v\n", server.Id, err)
+		return nil
+	}
+	defer cleanup()
+
+	var uploaded []string
+	for _, cfg := range targets {
+		if err := uploadToTarget(cfg, backupFile, backupKey(server.Id, backup.Path)); err != nil {
+			logger.Errorf("Failed to upload backup %s to target %s: %v\n", backup.Path, cfg.Name, err)
+			continue
+		}
+		logger.Infof("Uploaded backup %s to target %s\n", backup.Path, cfg.Name)
+		uploaded = append(uploaded, cfg.Name)
+	}
+	return uploaded
+}
+
+func uploadToTarget(cfg config.BackupTarget, backupFile, key string) error {
+	target, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(backupFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	return target.Put(ctx, key, file, info.Size())
+}
+
+func downloadFromTarget(name, key string) (string, error) {
+	cfg, ok := config.GetBackupTarget(name)
+	if !ok {
+		return "", fmt.Errorf("backup target %s is not configured", name)
+	}
+	target, err := storage.New(*cfg)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	reader, err := target.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	tempFile := filepath.Join(os.TempDir(), "pst-backup-"+uuid.New().String()+filepath.Ext(key))
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err = io.Copy(file, reader); err != nil {
+		os.Remove(tempFile)
+		return "", err
+	}
+	return tempFile, nil
+}
+
+func deleteFromTarget(name, key string) error {
+	cfg, ok := config.GetBackupTarget(name)
+	if !ok {
+		return fmt.Errorf("backup target %s is not configured", name)
+	}
+	target, err := storage.New(*cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	return target.Delete(ctx, key)
+}
+
+// DeleteBackupFilesByServer removes the local archive and every remote copy of a backup
+func DeleteBackupFilesByServer(backup *database.Backup) error {
+	if err := removeLocalBackup(backup); err != nil {
+		return err
+	}
+	if isChunkedBackup(backup) {
+		gcChunkStore()
+	}
+	for _, name := range backup.Targets {
+		if err := deleteFromTarget(name, backupKey(backup.ServerId, backup.Path)); err != nil {
+			logger.Warnf("Failed to delete backup %s from target %s: %v\n", backup.Path, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package tool
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/service"
+	"go.etcd.io/bbolt"
+)
+
+type BackupEntry struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	PlayerUid string    `json:"player_uid,omitempty"`
+	Nickname  string    `json:"nickname,omitempty"`
+}
+
+// ListBackupEntriesByServer lists the files inside a backup. Players/*.sav files are
+// mapped to the known players of the server.
+func ListBackupEntriesByServer(db *bbolt.DB, backup *database.Backup) ([]BackupEntry, error) {
+	var entries []BackupEntry
+	if isChunkedBackup(backup) && hasLocalBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := store.GetManifest(backupKey(backup.ServerId, backup.Path))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range manifest.Files {
+			entries = append(entries, BackupEntry{Name: file.Name, Size: file.Size, ModTime: file.ModTime})
+		}
+	} else {
+		backupFile, cleanup, err := FetchBackupByServer(backup)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		reader, err := zip.OpenReader(backupFile)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			entries = append(entries, BackupEntry{Name: file.Name, Size: int64(file.UncompressedSize64), ModTime: file.Modified})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	players, err := service.ListPlayersByServer(db, backup.ServerId)
+	if err != nil {
+		return entries, nil
+	}
+	for i, entry := range entries {
+		if !isPlayerSav(entry.Name) {
+			continue
+		}
+		for _, player := range players {
+			if matchPlayerSav(entry.Name, player.PlayerUid) {
+				entries[i].PlayerUid = player.PlayerUid
+				entries[i].Nickname = player.Nickname
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+// WriteBackupEntryByServer writes a single file of a backup to w
+func WriteBackupEntryByServer(backup *database.Backup, name string, w io.Writer) error {
+	if isChunkedBackup(backup) && hasLocalBackup(backup) {
+		store, err := getChunkStore()
+		if err != nil {
+			return err
+		}
+		return store.WriteFile(backupKey(backup.ServerId, backup.Path), name, w)
+	}
+
+	backupFile, cleanup, err := FetchBackupByServer(backup)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	reader, err := zip.OpenReader(backupFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.Name != name || file.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(w, rc)
+		return err
+	}
+	return os.ErrNotExist
+}
+
+// FindPlayerSavByServer returns the name of the Players/*.sav file of a player in a backup
+func FindPlayerSavByServer(db *bbolt.DB, backup *database.Backup, playerUid string) (string, error) {
+	entries, err := ListBackupEntriesByServer(db, backup)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if isPlayerSav(entry.Name) && matchPlayerSav(entry.Name, playerUid) {
+			return entry.Name, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func isPlayerSav(name string) bool {
+	return path.Dir(name) == "Players" && strings.HasSuffix(name, ".sav")
+}
+
+// matchPlayerSav reports whether a Players/<guid>.sav file belongs to playerUid. The uid
+// may be the full guid with or without dashes, its first 8 hex digits, or those digits
+// in decimal as reported by the REST API.
+func matchPlayerSav(name, playerUid string) bool {
+	guid := strings.ToLower(strings.TrimSuffix(path.Base(name), ".sav"))
+	uid := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(playerUid), "-", ""))
+	if uid == "" || len(guid) < 8 {
+		return false
+	}
+	if uid == guid {
+		return true
+	}
+	if len(uid) == 8 && uid == guid[:8] {
+		return true
+	}
+	if decimal, err := strconv.ParseUint(guid[:8], 16, 32); err == nil {
+		if strconv.FormatUint(decimal, 10) == strings.TrimLeft(uid, "0") {
+			return true
+		}
+	}
+	return false
+}
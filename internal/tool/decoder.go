@@ -0,0 +1,175 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/zaigie/palworld-server-tool/internal/auth"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+// maxStderrTail is how much of the sav_cli error output is kept for a failed decode
+const maxStderrTail = 4096
+
+var (
+	decodeSemOnce sync.Once
+	// decodeSem limits how many sav_cli run at once across all servers
+	decodeSem chan struct{}
+)
+
+// DecodeError is a failed sav_cli run with the end of its error output
+type DecodeError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return strings.ToValidUTF8(string(t.buf), "")
+}
+
+// logWriter logs the output of sav_cli line by line, tagged with the save it decodes
+type logWriter struct {
+	key     string
+	stderr  bool
+	tail    *tailBuffer
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.tail != nil {
+		w.tail.Write(p)
+	}
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.log(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line when it doesn't end with a newline
+func (w *logWriter) Flush() {
+	w.log(w.partial)
+	w.partial = nil
+}
+
+func (w *logWriter) log(line []byte) {
+	text := strings.TrimSpace(strings.ToValidUTF8(string(line), ""))
+	if text == "" {
+		return
+	}
+	if w.stderr {
+		logger.Warnf("sav_cli %s | %s\n", w.key, text)
+	} else {
+		logger.Infof("sav_cli %s | %s\n", w.key, text)
+	}
+}
+
+// acquireDecode waits until fewer than save.decode_concurrency decodes run
+func acquireDecode() func() {
+	decodeSemOnce.Do(func() {
+		decodeSem = make(chan struct{}, max(viper.GetInt("save.decode_concurrency"), 1))
+	})
+	decodeSem <- struct{}{}
+	return func() {
+		<-decodeSem
+	}
+}
+
+// decodeLevelFile runs sav_cli on a Level.sav, which puts the players and guilds to the api
+func decodeLevelFile(key, savCli, levelFilePath string) error {
+	baseUrl := fmt.Sprintf("http://127.0.0.1:%d", viper.GetInt("web.port"))
+	if viper.GetBool("web.tls") && !strings.HasSuffix(baseUrl, "/") {
+		baseUrl = viper.GetString("web.public_url")
+	}
+
+	requestUrl := fmt.Sprintf("%s/api/", baseUrl)
+	tokenString, err := auth.GenerateToken()
+	if err != nil {
+		return errors.New("error generating token: " + err.Error())
+	}
+	return runSavCli(key, savCli, levelFilePath, requestUrl, tokenString)
+}
+
+// runSavCli runs sav_cli on a Level.sav, putting the players and guilds to requestUrl.
+// It waits for a free slot of save.decode_concurrency, is killed with the processes it
+// started after save.decode_timeout seconds and its address space is limited to
+// save.decode_memory_limit MB on linux.
+func runSavCli(key, savCli, levelFilePath, requestUrl, tokenString string) error {
+	release := acquireDecode()
+	defer release()
+
+	ctx := context.Background()
+	if timeout := viper.GetInt("save.decode_timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	execArgs := []string{"-f", levelFilePath, "--request", requestUrl, "--token", tokenString}
+	cmd := exec.CommandContext(ctx, savCli, execArgs...)
+	system.SetProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return system.KillProcessGroup(cmd)
+	}
+	// don't wait for pipes held open by children that survived the kill
+	cmd.WaitDelay = 10 * time.Second
+	if limit := viper.GetInt64("save.decode_memory_limit"); limit > 0 {
+		if err := system.LimitMemory(cmd, limit<<20); err != nil {
+			logger.Warnf("Decoding %s without memory limit: %v\n", key, err)
+		}
+	}
+
+	stderrTail := &tailBuffer{max: maxStderrTail}
+	stdout := &logWriter{key: key}
+	stderr := &logWriter{key: key, stderr: true, tail: stderrTail}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Start()
+	if err != nil {
+		return errors.New("error starting command: " + err.Error())
+	}
+	err = cmd.Wait()
+	stdout.Flush()
+	stderr.Flush()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &DecodeError{Err: fmt.Errorf("sav_cli timed out after %d seconds", viper.GetInt("save.decode_timeout")), Stderr: stderrTail.String()}
+	}
+	if err != nil {
+		return &DecodeError{Err: errors.New("error waiting for command: " + err.Error()), Stderr: stderrTail.String()}
+	}
+	return nil
+}
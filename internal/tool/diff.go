@@ -0,0 +1,466 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/service"
+	"go.etcd.io/bbolt"
+)
+
+// CurrentSnapshot names the data of the last save sync in a diff
+const CurrentSnapshot = "current"
+
+type PlayerRef struct {
+	PlayerUid string `json:"player_uid"`
+	Nickname  string `json:"nickname"`
+	Level     int32  `json:"level"`
+}
+
+type PalRef struct {
+	Type     string `json:"type"`
+	Nickname string `json:"nickname"`
+	Level    int32  `json:"level"`
+}
+
+type ItemChange struct {
+	Container string `json:"container"`
+	ItemId    string `json:"item_id"`
+	From      int32  `json:"from"`
+	To        int32  `json:"to"`
+	Delta     int32  `json:"delta"`
+}
+
+type PlayerDiff struct {
+	PlayerUid  string       `json:"player_uid"`
+	Nickname   string       `json:"nickname"`
+	LevelFrom  int32        `json:"level_from"`
+	LevelTo    int32        `json:"level_to"`
+	LevelDelta int32        `json:"level_delta"`
+	ExpDelta   int64        `json:"exp_delta"`
+	PalsGained []PalRef     `json:"pals_gained"`
+	PalsLost   []PalRef     `json:"pals_lost"`
+	Items      []ItemChange `json:"items"`
+}
+
+type GuildDiff struct {
+	AdminPlayerUid    string                 `json:"admin_player_uid"`
+	Name              string                 `json:"name"`
+	Status            string                 `json:"status"` // added, removed, changed
+	BaseCampLevelFrom int32                  `json:"base_camp_level_from"`
+	BaseCampLevelTo   int32                  `json:"base_camp_level_to"`
+	MembersJoined     []database.GuildPlayer `json:"members_joined"`
+	MembersLeft       []database.GuildPlayer `json:"members_left"`
+	BaseCampsAdded    []database.BaseCamp    `json:"base_camps_added"`
+	BaseCampsRemoved  []database.BaseCamp    `json:"base_camps_removed"`
+}
+
+type SaveDiff struct {
+	From           string       `json:"from"`
+	To             string       `json:"to"`
+	PlayersAdded   []PlayerRef  `json:"players_added"`
+	PlayersRemoved []PlayerRef  `json:"players_removed"`
+	Players        []PlayerDiff `json:"players"`
+	Guilds         []GuildDiff  `json:"guilds"`
+}
+
+const decodedCacheSize = 4
+
+var (
+	decodedMu    sync.Mutex
+	decodedCache = make(map[string]*Sturcture)
+	decodedOrder []string
+)
+
+// DiffSnapshotsByServer compares two backups of a server. Either side may be
+// CurrentSnapshot for the data of the last save sync.
+func DiffSnapshotsByServer(db *bbolt.DB, server *config.Server, from, to string) (*SaveDiff, error) {
+	before, err := loadSnapshotByServer(db, server, from)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", from, err)
+	}
+	after, err := loadSnapshotByServer(db, server, to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", to, err)
+	}
+	diff := DiffSnapshots(before, after)
+	diff.From, diff.To = from, to
+	return diff, nil
+}
+
+func loadSnapshotByServer(db *bbolt.DB, server *config.Server, id string) (*Sturcture, error) {
+	if id == CurrentSnapshot {
+		return currentSnapshotByServer(db, server.Id)
+	}
+	backup, err := service.GetBackupByServer(db, server.Id, id)
+	if err != nil {
+		if err == service.ErrNoRecord {
+			return nil, errors.New("backup not found")
+		}
+		return nil, err
+	}
+	return DecodeBackupByServer(server, backup)
+}
+
+func currentSnapshotByServer(db *bbolt.DB, serverId string) (*Sturcture, error) {
+	tersePlayers, err := service.ListPlayersByServer(db, serverId)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Sturcture{}
+	for _, tersePlayer := range tersePlayers {
+		player, err := service.GetPlayerByServer(db, serverId, tersePlayer.PlayerUid)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Players = append(snapshot.Players, *player)
+	}
+	if snapshot.Guilds, err = service.ListGuildsByServer(db, serverId); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// DecodeBackupByServer decodes the save of a backup with sav_cli. Backups do not
+// change, so the last few results are kept in memory.
+func DecodeBackupByServer(server *config.Server, backup *database.Backup) (*Sturcture, error) {
+	cacheKey := backupKey(backup.ServerId, backup.BackupId)
+	decodedMu.Lock()
+	cached, ok := decodedCache[cacheKey]
+	decodedMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	savCli, err := getSavCliWithConfig(server)
+	if err != nil {
+		return nil, errors.New("error getting executable path: " + err.Error())
+	}
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-diff-"+uuid.New().String())
+	if err = os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	if err = ExtractBackupByServer(backup, tempDir); err != nil {
+		return nil, fmt.Errorf("failed to extract backup: %s", err)
+	}
+	levelFile := filepath.Join(tempDir, "Level.sav")
+	if _, err = os.Stat(levelFile); err != nil {
+		return nil, errors.New("backup does not contain Level.sav")
+	}
+
+	decoded, err := decodeToStructure(savCli, levelFile)
+	if err != nil {
+		return nil, err
+	}
+
+	decodedMu.Lock()
+	defer decodedMu.Unlock()
+	if _, ok := decodedCache[cacheKey]; !ok {
+		decodedCache[cacheKey] = decoded
+		decodedOrder = append(decodedOrder, cacheKey)
+		if len(decodedOrder) > decodedCacheSize {
+			delete(decodedCache, decodedOrder[0])
+			decodedOrder = decodedOrder[1:]
+		}
+	}
+	return decoded, nil
+}
+
+// decodeToStructure runs sav_cli against a throwaway local endpoint instead of the
+// api, so the decoded players and guilds are collected without touching the database
+func decodeToStructure(savCli, levelFile string) (*Sturcture, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	decoded := &Sturcture{}
+	received := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/player", func(w http.ResponseWriter, r *http.Request) {
+		var players []database.Player
+		if err := json.NewDecoder(r.Body).Decode(&players); err != nil {
+			http.Error(w, `{"error":"invalid players"}`, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		decoded.Players, received = players, true
+		mu.Unlock()
+		w.Write([]byte(`{"success":true}`))
+	})
+	mux.HandleFunc("/api/guild", func(w http.ResponseWriter, r *http.Request) {
+		var guilds []database.Guild
+		if err := json.NewDecoder(r.Body).Decode(&guilds); err != nil {
+			http.Error(w, `{"error":"invalid guilds"}`, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		decoded.Guilds = guilds
+		mu.Unlock()
+		w.Write([]byte(`{"success":true}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true}`))
+	})
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(listener)
+	defer httpServer.Shutdown(context.Background())
+
+	requestUrl := fmt.Sprintf("http://%s/api/", listener.Addr().String())
+	if err = runSavCli("diff", savCli, levelFile, requestUrl, uuid.New().String()); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !received {
+		return nil, errors.New("sav_cli returned no players")
+	}
+	return decoded, nil
+}
+
+// DiffSnapshots reports the players, pals, items and guilds changed from before to after
+func DiffSnapshots(before, after *Sturcture) *SaveDiff {
+	diff := &SaveDiff{
+		PlayersAdded:   []PlayerRef{},
+		PlayersRemoved: []PlayerRef{},
+		Players:        []PlayerDiff{},
+		Guilds:         []GuildDiff{},
+	}
+
+	beforePlayers := make(map[string]*database.Player)
+	for i := range before.Players {
+		beforePlayers[before.Players[i].PlayerUid] = &before.Players[i]
+	}
+	afterPlayers := make(map[string]*database.Player)
+	for i := range after.Players {
+		player := &after.Players[i]
+		afterPlayers[player.PlayerUid] = player
+		old, ok := beforePlayers[player.PlayerUid]
+		if !ok {
+			diff.PlayersAdded = append(diff.PlayersAdded, PlayerRef{player.PlayerUid, player.Nickname, player.Level})
+			continue
+		}
+		if playerDiff, changed := diffPlayer(old, player); changed {
+			diff.Players = append(diff.Players, playerDiff)
+		}
+	}
+	for uid, player := range beforePlayers {
+		if _, ok := afterPlayers[uid]; !ok {
+			diff.PlayersRemoved = append(diff.PlayersRemoved, PlayerRef{player.PlayerUid, player.Nickname, player.Level})
+		}
+	}
+	sort.Slice(diff.PlayersAdded, func(i, j int) bool { return diff.PlayersAdded[i].PlayerUid < diff.PlayersAdded[j].PlayerUid })
+	sort.Slice(diff.PlayersRemoved, func(i, j int) bool { return diff.PlayersRemoved[i].PlayerUid < diff.PlayersRemoved[j].PlayerUid })
+	sort.Slice(diff.Players, func(i, j int) bool { return diff.Players[i].PlayerUid < diff.Players[j].PlayerUid })
+
+	beforeGuilds := make(map[string]*database.Guild)
+	for i := range before.Guilds {
+		beforeGuilds[before.Guilds[i].AdminPlayerUid] = &before.Guilds[i]
+	}
+	afterGuilds := make(map[string]*database.Guild)
+	for i := range after.Guilds {
+		guild := &after.Guilds[i]
+		afterGuilds[guild.AdminPlayerUid] = guild
+		if guildDiff, changed := diffGuild(beforeGuilds[guild.AdminPlayerUid], guild); changed {
+			diff.Guilds = append(diff.Guilds, guildDiff)
+		}
+	}
+	for uid, guild := range beforeGuilds {
+		if _, ok := afterGuilds[uid]; !ok {
+			guildDiff, _ := diffGuild(guild, nil)
+			diff.Guilds = append(diff.Guilds, guildDiff)
+		}
+	}
+	sort.Slice(diff.Guilds, func(i, j int) bool { return diff.Guilds[i].AdminPlayerUid < diff.Guilds[j].AdminPlayerUid })
+	return diff
+}
+
+func diffPlayer(before, after *database.Player) (PlayerDiff, bool) {
+	playerDiff := PlayerDiff{
+		PlayerUid:  after.PlayerUid,
+		Nickname:   after.Nickname,
+		LevelFrom:  before.Level,
+		LevelTo:    after.Level,
+		LevelDelta: after.Level - before.Level,
+		ExpDelta:   after.Exp - before.Exp,
+		PalsGained: []PalRef{},
+		PalsLost:   []PalRef{},
+		Items:      []ItemChange{},
+	}
+
+	// pals have no id in the save, so they are matched by what does not change over time
+	beforePals := make(map[string][]*database.Pal)
+	for _, pal := range before.Pals {
+		key := palKey(pal)
+		beforePals[key] = append(beforePals[key], pal)
+	}
+	for _, pal := range after.Pals {
+		key := palKey(pal)
+		if len(beforePals[key]) > 0 {
+			beforePals[key] = beforePals[key][1:]
+			continue
+		}
+		playerDiff.PalsGained = append(playerDiff.PalsGained, PalRef{pal.Type, pal.Nickname, pal.Level})
+	}
+	for _, pals := range beforePals {
+		for _, pal := range pals {
+			playerDiff.PalsLost = append(playerDiff.PalsLost, PalRef{pal.Type, pal.Nickname, pal.Level})
+		}
+	}
+	sortPalRefs(playerDiff.PalsGained)
+	sortPalRefs(playerDiff.PalsLost)
+
+	beforeItems := itemCounts(before.Items)
+	afterItems := itemCounts(after.Items)
+	for key, count := range afterItems {
+		if beforeItems[key] != count {
+			playerDiff.Items = append(playerDiff.Items, ItemChange{key[0], key[1], beforeItems[key], count, count - beforeItems[key]})
+		}
+	}
+	for key, count := range beforeItems {
+		if _, ok := afterItems[key]; !ok {
+			playerDiff.Items = append(playerDiff.Items, ItemChange{key[0], key[1], count, 0, -count})
+		}
+	}
+	sort.Slice(playerDiff.Items, func(i, j int) bool {
+		if playerDiff.Items[i].Container != playerDiff.Items[j].Container {
+			return playerDiff.Items[i].Container < playerDiff.Items[j].Container
+		}
+		return playerDiff.Items[i].ItemId < playerDiff.Items[j].ItemId
+	})
+
+	changed := playerDiff.LevelDelta != 0 || playerDiff.ExpDelta != 0 ||
+		len(playerDiff.PalsGained) > 0 || len(playerDiff.PalsLost) > 0 || len(playerDiff.Items) > 0
+	return playerDiff, changed
+}
+
+func palKey(pal *database.Pal) string {
+	skills := append([]string(nil), pal.Skills...)
+	sort.Strings(skills)
+	return strings.Join([]string{
+		pal.Type, pal.Nickname, pal.Gender,
+		fmt.Sprint(pal.IsLucky), fmt.Sprint(pal.IsBoss), fmt.Sprint(pal.IsTower),
+		strings.Join(skills, ","),
+	}, "|")
+}
+
+func sortPalRefs(pals []PalRef) {
+	sort.Slice(pals, func(i, j int) bool {
+		if pals[i].Type != pals[j].Type {
+			return pals[i].Type < pals[j].Type
+		}
+		return pals[i].Level < pals[j].Level
+	})
+}
+
+// itemCounts sums the stacks of every item per container
+func itemCounts(items *database.Items) map[[2]string]int32 {
+	counts := make(map[[2]string]int32)
+	if items == nil {
+		return counts
+	}
+	containers := map[string][]*database.Item{
+		"CommonContainerId":           items.CommonContainerId,
+		"DropSlotContainerId":         items.DropSlotContainerId,
+		"EssentialContainerId":        items.EssentialContainerId,
+		"FoodEquipContainerId":        items.FoodEquipContainerId,
+		"PlayerEquipArmorContainerId": items.PlayerEquipArmorContainerId,
+		"WeaponLoadOutContainerId":    items.WeaponLoadOutContainerId,
+	}
+	for container, slots := range containers {
+		for _, item := range slots {
+			if item == nil || item.ItemId == "" || item.ItemId == "None" {
+				continue
+			}
+			counts[[2]string{container, item.ItemId}] += item.StackCount
+		}
+	}
+	return counts
+}
+
+// diffGuild compares a guild, before or after is nil when it was added or removed
+func diffGuild(before, after *database.Guild) (GuildDiff, bool) {
+	var guildDiff GuildDiff
+	var beforeMembers, afterMembers []*database.GuildPlayer
+	var beforeCamps, afterCamps []database.BaseCamp
+	switch {
+	case before == nil:
+		guildDiff = GuildDiff{AdminPlayerUid: after.AdminPlayerUid, Name: after.Name, Status: "added"}
+	case after == nil:
+		guildDiff = GuildDiff{AdminPlayerUid: before.AdminPlayerUid, Name: before.Name, Status: "removed"}
+	default:
+		guildDiff = GuildDiff{AdminPlayerUid: after.AdminPlayerUid, Name: after.Name, Status: "changed"}
+	}
+	if before != nil {
+		guildDiff.BaseCampLevelFrom = before.BaseCampLevel
+		beforeMembers, beforeCamps = before.Players, before.BaseCamp
+	}
+	if after != nil {
+		guildDiff.BaseCampLevelTo = after.BaseCampLevel
+		afterMembers, afterCamps = after.Players, after.BaseCamp
+	}
+
+	guildDiff.MembersJoined = []database.GuildPlayer{}
+	guildDiff.MembersLeft = []database.GuildPlayer{}
+	beforeUids := make(map[string]bool)
+	for _, member := range beforeMembers {
+		if member != nil {
+			beforeUids[member.PlayerUid] = true
+		}
+	}
+	afterUids := make(map[string]bool)
+	for _, member := range afterMembers {
+		if member == nil {
+			continue
+		}
+		afterUids[member.PlayerUid] = true
+		if !beforeUids[member.PlayerUid] {
+			guildDiff.MembersJoined = append(guildDiff.MembersJoined, *member)
+		}
+	}
+	for _, member := range beforeMembers {
+		if member != nil && !afterUids[member.PlayerUid] {
+			guildDiff.MembersLeft = append(guildDiff.MembersLeft, *member)
+		}
+	}
+
+	guildDiff.BaseCampsAdded = []database.BaseCamp{}
+	guildDiff.BaseCampsRemoved = []database.BaseCamp{}
+	beforeIds := make(map[string]bool)
+	for _, camp := range beforeCamps {
+		beforeIds[camp.Id] = true
+	}
+	afterIds := make(map[string]bool)
+	for _, camp := range afterCamps {
+		afterIds[camp.Id] = true
+		if !beforeIds[camp.Id] {
+			guildDiff.BaseCampsAdded = append(guildDiff.BaseCampsAdded, camp)
+		}
+	}
+	for _, camp := range beforeCamps {
+		if !afterIds[camp.Id] {
+			guildDiff.BaseCampsRemoved = append(guildDiff.BaseCampsRemoved, camp)
+		}
+	}
+
+	changed := guildDiff.Status != "changed" || guildDiff.BaseCampLevelFrom != guildDiff.BaseCampLevelTo ||
+		(before != nil && after != nil && before.Name != after.Name) ||
+		len(guildDiff.MembersJoined) > 0 || len(guildDiff.MembersLeft) > 0 ||
+		len(guildDiff.BaseCampsAdded) > 0 || len(guildDiff.BaseCampsRemoved) > 0
+	return guildDiff, changed
+}
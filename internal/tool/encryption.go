@@ -0,0 +1,193 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/service"
+	"go.etcd.io/bbolt"
+)
+
+var errNoBackupKey = errors.New("backup is encrypted but no backup encryption key is configured")
+
+var (
+	backupKeyMu     sync.Mutex
+	cachedBackupKey *crypt.Key
+	backupKeyCfg    config.BackupEncryption
+)
+
+// NewBackupKey returns the key for a passphrase or key file, nil when both are empty
+func NewBackupKey(passphrase, keyFile string) (*crypt.Key, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, errors.New("set either a backup encryption passphrase or a key file, not both")
+	}
+	if keyFile != "" {
+		return crypt.LoadKeyFile(keyFile)
+	}
+	if passphrase != "" {
+		return crypt.NewPassphraseKey(passphrase), nil
+	}
+	return nil, nil
+}
+
+// getBackupKey returns the configured backup encryption key, nil when encryption is off
+func getBackupKey() (*crypt.Key, error) {
+	var cfg config.BackupEncryption
+	if globalConfig := config.GetConfig(); globalConfig != nil {
+		cfg = globalConfig.Backup.Encryption
+	}
+	backupKeyMu.Lock()
+	defer backupKeyMu.Unlock()
+	if cachedBackupKey != nil && cfg == backupKeyCfg {
+		return cachedBackupKey, nil
+	}
+	key, err := NewBackupKey(cfg.Passphrase, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup encryption key: %s", err)
+	}
+	cachedBackupKey, backupKeyCfg = key, cfg
+	return key, nil
+}
+
+// decryptBackupFile decrypts an encrypted archive into a temporary zip with the
+// first of keys that fits
+func decryptBackupFile(backupFile string, keys ...*crypt.Key) (string, error) {
+	tempFile := filepath.Join(os.TempDir(), "pst-backup-"+uuid.New().String()+".zip")
+	err := errNoBackupKey
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		err = crypt.DecryptFile(backupFile, tempFile, key)
+		if !errors.Is(err, crypt.ErrWrongKey) {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	return tempFile, nil
+}
+
+// RotateBackupKey re-encrypts every backup of every server with newKey: local archives,
+// the chunk store and the copies on backup targets. Unencrypted backups are encrypted.
+// Archives are read with the configured key, so update the config only afterwards.
+// A failed rotation can be run again.
+func RotateBackupKey(db *bbolt.DB, newKey *crypt.Key) error {
+	if newKey == nil {
+		return errors.New("no new backup encryption key given")
+	}
+
+	store, err := getChunkStore()
+	if err != nil {
+		return err
+	}
+	logger.Info("Re-encrypting backup chunks...\n")
+	if err = store.Rekey(newKey); err != nil {
+		return fmt.Errorf("failed to re-encrypt backup chunks: %s", err)
+	}
+
+	backups, err := service.ListBackups(db, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, backup := range backups {
+		if backup.ServerId == "" {
+			// single server backups predate encryption
+			continue
+		}
+		if err := rotateBackup(db, &backup, newKey); err != nil {
+			logger.Errorf("Failed to re-encrypt backup %s of server %s: %v\n", backup.Path, backup.ServerId, err)
+			failed++
+			continue
+		}
+		logger.Infof("Re-encrypted backup %s of server %s\n", backup.Path, backup.ServerId)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be re-encrypted", failed)
+	}
+	return nil
+}
+
+func rotateBackup(db *bbolt.DB, backup *database.Backup, newKey *crypt.Key) error {
+	rotated := *backup
+	rotated.Encrypted = true
+	if !isChunkedBackup(backup) && !strings.HasSuffix(backup.Path, ".enc") {
+		rotated.Path = backup.Path + ".enc"
+	}
+
+	var newFile string
+	if isChunkedBackup(backup) {
+		if len(backup.Targets) == 0 {
+			return service.AddBackupByServer(db, backup.ServerId, rotated)
+		}
+		// the chunk store already holds the new key, so the export is encrypted with it
+		exportFile, cleanup, err := exportArchiveByServer(&rotated, newKey)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		newFile = exportFile
+	} else {
+		oldKey, err := getBackupKey()
+		if err != nil {
+			return err
+		}
+		// the new key opens archives re-encrypted by an interrupted earlier run
+		plainFile, cleanup, err := fetchBackupWithKeys(backup, oldKey, newKey)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		hadLocal := hasLocalBackup(backup)
+		if hadLocal {
+			newFile, err = GetBackupFilePathByServer(backup.ServerId, rotated.Path)
+			if err != nil {
+				return err
+			}
+		} else {
+			newFile = filepath.Join(os.TempDir(), "pst-backup-"+uuid.New().String()+".zip.enc")
+			defer os.Remove(newFile)
+		}
+		if err = crypt.EncryptFile(plainFile, newFile, newKey); err != nil {
+			return err
+		}
+		if hadLocal && rotated.Path != backup.Path {
+			if err = removeLocalBackup(backup); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range backup.Targets {
+		cfg, ok := config.GetBackupTarget(name)
+		if !ok {
+			return fmt.Errorf("backup target %s is not configured", name)
+		}
+		if err := uploadToTarget(*cfg, newFile, backupKey(backup.ServerId, rotated.Path)); err != nil {
+			return fmt.Errorf("failed to upload to target %s: %s", name, err)
+		}
+		if rotated.Path != backup.Path {
+			if err := deleteFromTarget(name, backupKey(backup.ServerId, backup.Path)); err != nil {
+				logger.Warnf("Failed to remove old backup %s from target %s: %v\n", backup.Path, name, err)
+			}
+		}
+	}
+
+	if size, checksum, err := statLocalBackup(&rotated); err == nil {
+		rotated.Size, rotated.Sha256 = size, checksum
+	}
+	return service.AddBackupByServer(db, backup.ServerId, rotated)
+}
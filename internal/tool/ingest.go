@@ -0,0 +1,43 @@
+package tool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+)
+
+// UnpackIngest extracts a sav.zip pushed by pst-agent into a temporary directory
+// and returns the path of its Level.sav. The archive is removed.
+func UnpackIngest(zipFile string) (string, error) {
+	defer os.Remove(zipFile)
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-ingest-"+uuid.New().String())
+	if err := system.UnzipDir(zipFile, tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", errors.New("error extracting pushed save: " + err.Error())
+	}
+	levelFilePath := filepath.Join(tempDir, "Level.sav")
+	if err := system.CheckSavHeader(levelFilePath); err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	return levelFilePath, nil
+}
+
+// DecodeIngested decodes a save unpacked by UnpackIngest and removes it afterwards
+func DecodeIngested(server *config.Server, levelFilePath string) error {
+	defer os.RemoveAll(filepath.Dir(levelFilePath))
+
+	savCli, err := getSavCliWithConfig(server)
+	if err != nil {
+		return errors.New("error getting executable path: " + err.Error())
+	}
+	logger.Infof("Decoding save pushed for server %s\n", server.Id)
+	_, err = decodeIfChanged(server.Id, savCli, levelFilePath, false)
+	return err
+}
@@ -439,3 +439,11 @@ func DoExitWithConfig(serverConfig *config.Server) error {
 	}
 	return nil
 }
+
+func SaveWithConfig(serverConfig *config.Server) error {
+	_, err := callApiWithConfig(serverConfig, "POST", "/v1/api/save", nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
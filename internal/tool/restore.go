@@ -0,0 +1,324 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/source"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+	"go.etcd.io/bbolt"
+)
+
+var ErrRestoreRunning = errors.New("a restore is already running for this server")
+
+type RestoreOptions struct {
+	DryRun          bool   `json:"dry_run"`
+	Shutdown        bool   `json:"shutdown"`
+	ShutdownSeconds int    `json:"shutdown_seconds"`
+	ShutdownMessage string `json:"shutdown_message"`
+	// Files limits the restore to these .sav files of the backup, e.g. Players/<uid>.sav
+	Files []string `json:"files"`
+}
+
+type RestoreFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Target string `json:"target"`
+}
+
+type RestorePlan struct {
+	ServerId string        `json:"server_id"`
+	BackupId string        `json:"backup_id"`
+	SavDir   string        `json:"sav_dir"`
+	Files    []RestoreFile `json:"files"`
+}
+
+type RestoreProgress struct {
+	Id             string        `json:"id"`
+	ServerId       string        `json:"server_id"`
+	BackupId       string        `json:"backup_id"`
+	State          string        `json:"state"` // running, success, failed
+	Step           string        `json:"step"`
+	Percent        int           `json:"percent"`
+	SafetyBackupId string        `json:"safety_backup_id"`
+	Files          []RestoreFile `json:"files"`
+	Error          string        `json:"error"`
+	StartTime      time.Time     `json:"start_time"`
+	EndTime        time.Time     `json:"end_time"`
+}
+
+// maxRestores is how many finished restores are kept for the progress endpoint
+const maxRestores = 50
+
+var (
+	restoreMu       sync.Mutex
+	restores        = make(map[string]*RestoreProgress)
+	runningRestores = make(map[string]string)
+)
+
+// GetRestoreProgress returns a snapshot of the progress of a restore
+func GetRestoreProgress(restoreId string) (RestoreProgress, bool) {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	progress, ok := restores[restoreId]
+	if !ok {
+		return RestoreProgress{}, false
+	}
+	return *progress, true
+}
+
+func updateRestore(progress *RestoreProgress, step string, percent int) {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	progress.Step = step
+	progress.Percent = percent
+	logger.Infof("Restore %s for server %s: %s\n", progress.Id, progress.ServerId, step)
+}
+
+func finishRestore(progress *RestoreProgress, err error) {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	progress.EndTime = time.Now()
+	if err != nil {
+		progress.State = "failed"
+		progress.Error = err.Error()
+		logger.Errorf("Restore %s for server %s failed: %v\n", progress.Id, progress.ServerId, err)
+	} else {
+		progress.State = "success"
+		progress.Step = "done"
+		progress.Percent = 100
+		logger.Infof("Restore %s for server %s done\n", progress.Id, progress.ServerId)
+	}
+	delete(runningRestores, progress.ServerId)
+}
+
+// pruneRestores drops the oldest finished restores beyond maxRestores, restoreMu must be held
+func pruneRestores() {
+	if len(restores) <= maxRestores {
+		return
+	}
+	finished := make([]*RestoreProgress, 0, len(restores))
+	for _, progress := range restores {
+		if progress.State != "running" {
+			finished = append(finished, progress)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartTime.Before(finished[j].StartTime)
+	})
+	excess := len(restores) - maxRestores
+	for i := 0; i < excess && i < len(finished); i++ {
+		delete(restores, finished[i].Id)
+	}
+}
+
+// PlanRestoreWithConfig extracts the backup and lists the files a restore would replace.
+// When files is not empty only those files are kept for the restore.
+func PlanRestoreWithConfig(server *config.Server, backup *database.Backup, files []string) (*RestorePlan, string, error) {
+	if server.Save.Path == "" {
+		return nil, "", errors.New("save path not configured for server")
+	}
+
+	tempDir := filepath.Join(os.TempDir(), "palworldsav-restore-"+uuid.New().String())
+	if err := system.CleanAndCreateDir(tempDir); err != nil {
+		return nil, "", err
+	}
+	err := ExtractBackupByServer(backup, tempDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, "", fmt.Errorf("failed to extract backup: %s", err)
+	}
+	if len(files) > 0 {
+		if err = selectRestoreFiles(tempDir, files); err != nil {
+			os.RemoveAll(tempDir)
+			return nil, "", err
+		}
+	} else if _, err = os.Stat(filepath.Join(tempDir, "Level.sav")); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, "", errors.New("backup does not contain Level.sav")
+	}
+
+	driver, err := openSaveSource(server, server.Save.Path)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, "", err
+	}
+	locator, ok := driver.(source.Locator)
+	if !ok {
+		os.RemoveAll(tempDir)
+		return nil, "", errors.New("restore is not supported for this save source")
+	}
+	savDir, err := locator.SavDir()
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, "", err
+	}
+	_, isLocal := driver.(*source.LocalDriver)
+
+	names, err := system.ListSavFiles(tempDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, "", err
+	}
+	plan := &RestorePlan{
+		ServerId: server.Id,
+		BackupId: backup.BackupId,
+		SavDir:   savDir,
+		Files:    make([]RestoreFile, 0, len(names)),
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(tempDir, filepath.FromSlash(name)))
+		if err != nil {
+			os.RemoveAll(tempDir)
+			return nil, "", err
+		}
+		target := path.Join(savDir, name)
+		if isLocal {
+			target = filepath.Join(savDir, filepath.FromSlash(name))
+		}
+		plan.Files = append(plan.Files, RestoreFile{Name: name, Size: info.Size(), Target: target})
+	}
+	return plan, tempDir, nil
+}
+
+// selectRestoreFiles removes every save file below dir except files
+func selectRestoreFiles(dir string, files []string) error {
+	keep := make(map[string]bool, len(files))
+	for _, name := range files {
+		name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+		if !strings.HasSuffix(name, ".sav") || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid save file name %s", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("backup does not contain %s", name)
+		}
+		keep[name] = true
+	}
+	names, err := system.ListSavFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if keep[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRestoreWithConfig runs a restore of the backup in the background and returns its progress id
+func StartRestoreWithConfig(db *bbolt.DB, server *config.Server, backup *database.Backup, opts RestoreOptions) (string, error) {
+	restoreMu.Lock()
+	if _, ok := runningRestores[server.Id]; ok {
+		restoreMu.Unlock()
+		return "", ErrRestoreRunning
+	}
+	progress := &RestoreProgress{
+		Id:        uuid.New().String(),
+		ServerId:  server.Id,
+		BackupId:  backup.BackupId,
+		State:     "running",
+		Step:      "pending",
+		StartTime: time.Now(),
+	}
+	restores[progress.Id] = progress
+	runningRestores[server.Id] = progress.Id
+	pruneRestores()
+	restoreMu.Unlock()
+
+	go func() {
+		finishRestore(progress, restoreWithConfig(db, server, backup, opts, progress))
+	}()
+	return progress.Id, nil
+}
+
+func restoreWithConfig(db *bbolt.DB, server *config.Server, backup *database.Backup, opts RestoreOptions, progress *RestoreProgress) error {
+	updateRestore(progress, "extracting backup", 5)
+	plan, tempDir, err := PlanRestoreWithConfig(server, backup, opts.Files)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	restoreMu.Lock()
+	progress.Files = plan.Files
+	restoreMu.Unlock()
+
+	updateRestore(progress, "creating safety backup", 15)
+	safety, err := NewBackupWithConfig(db, server, BackupOptions{
+		Trigger: database.BackupTriggerPreRestore,
+		Label:   "Before restoring " + backup.BackupId,
+	})
+	if err != nil {
+		return fmt.Errorf("safety backup failed: %s", err)
+	}
+	restoreMu.Lock()
+	progress.SafetyBackupId = safety.BackupId
+	restoreMu.Unlock()
+
+	if opts.Shutdown {
+		updateRestore(progress, "shutting down server", 35)
+		if err = shutdownForRestore(server, opts); err != nil {
+			return err
+		}
+	}
+
+	updateRestore(progress, "writing save files", 70)
+	driver, err := openSaveSource(server, server.Save.Path)
+	if err != nil {
+		return err
+	}
+	if err = driver.Write(tempDir); err != nil {
+		return fmt.Errorf("failed to write save files: %s", err)
+	}
+	return nil
+}
+
+func shutdownForRestore(server *config.Server, opts RestoreOptions) error {
+	seconds := opts.ShutdownSeconds
+	if seconds <= 0 {
+		seconds = 60
+	}
+	message := opts.ShutdownMessage
+	if message == "" {
+		message = "Server is shutting down to restore a backup"
+	}
+	if err := ShutdownWithConfig(server, seconds, message); err != nil {
+		return fmt.Errorf("failed to shut down server: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+	for _, mark := range []int{300, 120, 60, 30, 10, 5} {
+		if mark >= seconds {
+			continue
+		}
+		time.Sleep(time.Until(deadline.Add(-time.Duration(mark) * time.Second)))
+		if err := BroadcastWithConfig(server, fmt.Sprintf("Restoring backup in %d seconds", mark)); err != nil {
+			logger.Warnf("Broadcast fail for server %s, %s \n", server.Id, err)
+		}
+	}
+	time.Sleep(time.Until(deadline))
+
+	// wait for the game to stop answering before touching its save files
+	deadline = time.Now().Add(2 * time.Minute)
+	for time.Now().Before(deadline) {
+		if _, err := InfoWithConfig(server); err != nil {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return errors.New("server is still running after shutdown")
+}
@@ -0,0 +1,102 @@
+package tool
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+)
+
+type RetentionDecision struct {
+	Backup  database.Backup `json:"backup"`
+	Keep    bool            `json:"keep"`
+	Reasons []string        `json:"reasons"`
+}
+
+// PlanBackupRetention decides which backups to keep. With an enabled policy every backup
+// younger than KeepAllHours is kept, plus the newest backup of each of the last Daily days,
+// Weekly ISO weeks and Monthly months. Otherwise backups younger than keepDays are kept.
+// Pinned backups are always kept.
+func PlanBackupRetention(backups []database.Backup, policy config.BackupRetention, keepDays int, now time.Time) []RetentionDecision {
+	sorted := make([]database.Backup, len(backups))
+	copy(sorted, backups)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].SaveTime.Before(sorted[j].SaveTime)
+	})
+
+	decisions := make([]RetentionDecision, len(sorted))
+	for i, backup := range sorted {
+		decisions[i] = RetentionDecision{Backup: backup, Reasons: []string{}}
+	}
+
+	if !policy.Enabled() {
+		if keepDays <= 0 {
+			keepDays = 7
+		}
+		cutoff := now.AddDate(0, 0, -keepDays)
+		for i := range decisions {
+			if !decisions[i].Backup.SaveTime.Before(cutoff) {
+				decisions[i].Reasons = append(decisions[i].Reasons, "keep_days")
+			}
+		}
+	} else {
+		recentCutoff := now.Add(-time.Duration(policy.KeepAllHours) * time.Hour)
+		for i := range decisions {
+			if policy.KeepAllHours > 0 && !decisions[i].Backup.SaveTime.Before(recentCutoff) {
+				decisions[i].Reasons = append(decisions[i].Reasons, "recent")
+			}
+		}
+
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		keepLastPerPeriod(decisions, "daily", policy.Daily, today.AddDate(0, 0, -(policy.Daily-1)), func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+		thisWeek := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		keepLastPerPeriod(decisions, "weekly", policy.Weekly, thisWeek.AddDate(0, 0, -7*(policy.Weekly-1)), func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		})
+		thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		keepLastPerPeriod(decisions, "monthly", policy.Monthly, thisMonth.AddDate(0, -(policy.Monthly-1), 0), func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+	}
+
+	for i := range decisions {
+		if decisions[i].Backup.Pinned {
+			decisions[i].Reasons = append(decisions[i].Reasons, "pinned")
+		}
+		decisions[i].Keep = len(decisions[i].Reasons) > 0
+	}
+	return decisions
+}
+
+// keepLastPerPeriod marks the newest backup of every period starting at or after since
+func keepLastPerPeriod(decisions []RetentionDecision, reason string, periods int, since time.Time, periodKey func(time.Time) string) {
+	if periods <= 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	for i := len(decisions) - 1; i >= 0; i-- {
+		saveTime := decisions[i].Backup.SaveTime.In(since.Location())
+		if saveTime.Before(since) {
+			continue
+		}
+		key := periodKey(saveTime)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+}
+
+func getKeepDays(server *config.Server) int {
+	keepDays := server.Save.BackupKeepDays
+	if keepDays == 0 {
+		keepDays = 7
+	}
+	return keepDays
+}
@@ -0,0 +1,140 @@
+package tool
+
+import (
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+)
+
+func TestPlanBackupRetention(t *testing.T) {
+	at := func(value string) time.Time {
+		saveTime, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saveTime
+	}
+	tests := []struct {
+		name     string
+		policy   config.BackupRetention
+		keepDays int
+		now      string
+		backups  []string // save times, a trailing * pins the backup
+		want     []string // save times of the kept backups
+	}{
+		{
+			name:     "keep_days",
+			keepDays: 2,
+			now:      "2026-03-10 12:00",
+			backups:  []string{"2026-03-08 11:59", "2026-03-08 12:00", "2026-03-10 11:00"},
+			want:     []string{"2026-03-08 12:00", "2026-03-10 11:00"},
+		},
+		{
+			name:     "keep_days 0 keeps a week",
+			keepDays: 0,
+			now:      "2026-03-10 12:00",
+			backups:  []string{"2026-03-03 11:59", "2026-03-03 12:00", "2026-03-10 11:00"},
+			want:     []string{"2026-03-03 12:00", "2026-03-10 11:00"},
+		},
+		{
+			name:    "recent",
+			policy:  config.BackupRetention{KeepAllHours: 6},
+			now:     "2026-03-10 12:00",
+			backups: []string{"2026-03-10 05:59", "2026-03-10 06:00", "2026-03-10 09:00"},
+			want:    []string{"2026-03-10 06:00", "2026-03-10 09:00"},
+		},
+		{
+			name:   "daily keeps the newest of each day",
+			policy: config.BackupRetention{Daily: 2},
+			now:    "2026-03-10 12:00",
+			backups: []string{
+				"2026-03-08 23:59",
+				"2026-03-09 00:00", "2026-03-09 13:00", "2026-03-09 23:59",
+				"2026-03-10 00:00", "2026-03-10 11:00",
+			},
+			want: []string{"2026-03-09 23:59", "2026-03-10 11:00"},
+		},
+		{
+			name:   "weekly across the iso year",
+			policy: config.BackupRetention{Weekly: 2},
+			// 2026-01-01 is a Thursday, so 2025-12-29 starts week 1 of 2026
+			now: "2026-01-07 12:00",
+			backups: []string{
+				"2025-12-28 23:59",
+				"2025-12-29 00:00", "2026-01-01 10:00", "2026-01-04 23:59",
+				"2026-01-05 00:00", "2026-01-06 10:00",
+			},
+			want: []string{"2026-01-04 23:59", "2026-01-06 10:00"},
+		},
+		{
+			name:   "monthly across the year",
+			policy: config.BackupRetention{Monthly: 2},
+			now:    "2026-01-10 12:00",
+			backups: []string{
+				"2025-11-30 23:59",
+				"2025-12-01 00:00", "2025-12-31 23:59",
+				"2026-01-01 00:00", "2026-01-09 10:00",
+			},
+			want: []string{"2025-12-31 23:59", "2026-01-09 10:00"},
+		},
+		{
+			name:   "tiers combined",
+			policy: config.BackupRetention{KeepAllHours: 1, Daily: 1, Monthly: 1},
+			now:    "2026-03-10 12:00",
+			backups: []string{
+				"2026-02-28 10:00",
+				"2026-03-01 10:00", "2026-03-09 10:00",
+				"2026-03-10 09:00", "2026-03-10 11:30",
+			},
+			want: []string{"2026-03-10 11:30"},
+		},
+		{
+			name:     "pinned",
+			policy:   config.BackupRetention{Daily: 1},
+			keepDays: 2,
+			now:      "2026-03-10 12:00",
+			backups:  []string{"2025-01-01 10:00*", "2026-03-09 10:00", "2026-03-10 09:00*", "2026-03-10 10:00"},
+			want:     []string{"2025-01-01 10:00", "2026-03-10 09:00", "2026-03-10 10:00"},
+		},
+	}
+	for _, tt := range tests {
+		backups := make([]database.Backup, 0, len(tt.backups))
+		// reversed to check the plan does not depend on the listing order
+		for i := len(tt.backups) - 1; i >= 0; i-- {
+			value := tt.backups[i]
+			pinned := value[len(value)-1] == '*'
+			if pinned {
+				value = value[:len(value)-1]
+			}
+			backups = append(backups, database.Backup{BackupId: value, SaveTime: at(value), Pinned: pinned})
+		}
+
+		decisions := PlanBackupRetention(backups, tt.policy, tt.keepDays, at(tt.now))
+		if len(decisions) != len(backups) {
+			t.Fatalf("%s: got %d decisions for %d backups", tt.name, len(decisions), len(backups))
+		}
+		var kept []string
+		for i, decision := range decisions {
+			if i > 0 && decision.Backup.SaveTime.Before(decisions[i-1].Backup.SaveTime) {
+				t.Errorf("%s: decisions are not sorted by save time", tt.name)
+			}
+			if decision.Keep != (len(decision.Reasons) > 0) {
+				t.Errorf("%s: %s kept %v for reasons %v", tt.name, decision.Backup.BackupId, decision.Keep, decision.Reasons)
+			}
+			if decision.Backup.Pinned && !slices.Contains(decision.Reasons, "pinned") {
+				t.Errorf("%s: pinned %s has reasons %v", tt.name, decision.Backup.BackupId, decision.Reasons)
+			}
+			if decision.Keep {
+				kept = append(kept, decision.Backup.BackupId)
+			}
+		}
+		sort.Strings(kept)
+		if !slices.Equal(kept, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.want)
+		}
+	}
+}
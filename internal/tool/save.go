@@ -1,18 +1,21 @@
 package tool
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
-	"github.com/zaigie/palworld-server-tool/internal/auth"
 	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/crypt"
 	"github.com/zaigie/palworld-server-tool/internal/database"
 	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/source"
@@ -21,6 +24,15 @@ import (
 	"go.etcd.io/bbolt"
 )
 
+// decodedVersions remembers the save version each address was last decoded from,
+// for sources that can tell an unchanged save. decodedChecksums holds the checksum
+// of the save files last decoded for each server or address.
+var (
+	decodedVersionsMu sync.Mutex
+	decodedVersions   = make(map[string]string)
+	decodedChecksums  = make(map[string]string)
+)
+
 type Sturcture struct {
 	Players []database.Player `json:"players"`
 	Guilds  []database.Guild  `json:"guilds"`
@@ -70,53 +82,126 @@ func Decode(file string) error {
 		return errors.New("error getting executable path: " + err.Error())
 	}
 
-	levelFilePath, err := getFromSource(file, "decode")
+	driver, err := source.Open(file)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(filepath.Dir(levelFilePath))
+	return decode(file, savCli, file, driver, false)
+}
 
-	baseUrl := fmt.Sprintf("http://127.0.0.1:%d", viper.GetInt("web.port"))
-	if viper.GetBool("web.tls") && !strings.HasSuffix(baseUrl, "/") {
-		baseUrl = viper.GetString("web.public_url")
+// openSaveSource returns the driver for a save address of the server, s3 addresses
+// get the endpoint and credentials of save.s3
+func openSaveSource(server *config.Server, address string) (source.Driver, error) {
+	if strings.HasPrefix(address, "s3://") {
+		s3 := server.Save.S3
+		return source.NewS3Driver(address, source.S3Options{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+		})
 	}
+	return source.Open(address)
+}
 
-	requestUrl := fmt.Sprintf("%s/api/", baseUrl)
-	tokenString, err := auth.GenerateToken()
+// decode fetches the save at file and decodes it with savCli unless its files are the same
+// as the last time key was decoded, source.ErrNotModified is returned then. force decodes anyway.
+func decode(key, savCli, file string, driver source.Driver, force bool) error {
+	var levelFilePath, version string
+	var err error
+	if fetcher, ok := driver.(source.ConditionalFetcher); ok {
+		lastVersion := ""
+		if !force {
+			decodedVersionsMu.Lock()
+			lastVersion = decodedVersions[file]
+			decodedVersionsMu.Unlock()
+		}
+		levelFilePath, version, err = fetcher.FetchIfChanged("decode", lastVersion)
+	} else {
+		levelFilePath, err = driver.Fetch("decode")
+	}
 	if err != nil {
-		return errors.New("error generating token: " + err.Error())
+		return err
 	}
-	execArgs := []string{"-f", levelFilePath, "--request", requestUrl, "--token", tokenString}
-	cmd := exec.Command(savCli, execArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	defer os.RemoveAll(filepath.Dir(levelFilePath))
+
+	checksum, err := decodeIfChanged(key, savCli, levelFilePath, force)
 	if err != nil {
-		return errors.New("error starting command: " + err.Error())
+		return err
+	}
+	if version != "" {
+		decodedVersionsMu.Lock()
+		decodedVersions[file] = version
+		decodedVersionsMu.Unlock()
 	}
-	err = cmd.Wait()
+	logger.Debugf("Save %s decoded, checksum %s\n", key, checksum)
+	return nil
+}
+
+// decodeIfChanged decodes a fetched Level.sav when the checksum of the save files differs
+// from the last one decoded for key, and returns the checksum
+func decodeIfChanged(key, savCli, levelFilePath string, force bool) (string, error) {
+	checksum, err := savChecksum(filepath.Dir(levelFilePath))
 	if err != nil {
-		return errors.New("error waiting for command: " + err.Error())
+		return "", errors.New("error hashing save: " + err.Error())
+	}
+	decodedVersionsMu.Lock()
+	unchanged := decodedChecksums[key] == checksum
+	decodedVersionsMu.Unlock()
+	if unchanged && !force {
+		return checksum, source.ErrNotModified
 	}
 
-	return nil
+	if err = decodeLevelFile(key, savCli, levelFilePath); err != nil {
+		return "", err
+	}
+	decodedVersionsMu.Lock()
+	decodedChecksums[key] = checksum
+	decodedVersionsMu.Unlock()
+	return checksum, nil
+}
+
+// savChecksum hashes the names and contents of the .sav files of savDir
+func savChecksum(savDir string) (string, error) {
+	names, err := system.ListSavFiles(savDir)
+	if err != nil {
+		return "", err
+	}
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		_, sum, err := system.Sha256File(filepath.Join(savDir, filepath.FromSlash(name)))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, name+" "+sum)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
 }
 
-func DecodeWithConfig(server *config.Server, file string) error {
-	_, err := getSavCliWithConfig(server)
+// DecodeWithConfig decodes the save of the server, skipping it with source.ErrNotModified
+// when the save files are unchanged since the last decode unless force is set
+func DecodeWithConfig(server *config.Server, file string, force bool) error {
+	savCli, err := getSavCliWithConfig(server)
 	if err != nil {
 		return errors.New("error getting executable path: " + err.Error())
 	}
 
-	// Implementation would be similar to Decode but using server config
-	// For now, just call the existing decode function
-	return Decode(file)
+	driver, err := openSaveSource(server, file)
+	if err != nil {
+		return err
+	}
+	return decode(server.Id, savCli, file, driver, force)
 }
 
 func Backup() (string, error) {
 	sourcePath := viper.GetString("save.path")
 
-	levelFilePath, err := getFromSource(sourcePath, "backup")
+	driver, err := source.Open(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	levelFilePath, err := driver.Fetch("backup")
 	if err != nil {
 		return "", err
 	}
@@ -180,70 +265,223 @@ func CleanOldBackups(db *bbolt.DB, keepDays int) error {
 	return nil
 }
 
-func getFromSource(file, way string) (string, error) {
-	var levelFilePath string
-	var err error
+// PreSaveWithConfig asks the game server to flush the world to disk, through the
+// REST API first and RCON as a fallback, then waits for the save files to settle
+func PreSaveWithConfig(server *config.Server) error {
+	driver, err := openSaveSource(server, server.Save.Path)
+	if err != nil {
+		return err
+	}
+	_, local := driver.(*source.LocalDriver)
+	var before source.Stat
+	if !local {
+		// remote clocks may be off, a changed checksum tells the save was written as well
+		if before, err = driver.Stat(); err != nil && !errors.Is(err, source.ErrNotSupported) {
+			logger.Warnf("Failed to stat save of server %s: %v\n", server.Id, err)
+		}
+	}
+	requestTime := time.Now().Truncate(time.Second)
 
-	if strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
-		// http(s)://url
-		levelFilePath, err = source.DownloadFromHttp(file, way)
-		if err != nil {
-			return "", errors.New("error downloading file: " + err.Error())
+	err = SaveWithConfig(server)
+	if err != nil {
+		logger.Warnf("REST save failed for server %s, falling back to RCON: %v\n", server.Id, err)
+		if _, rconErr := CustomCommandWithConfig(server, "Save"); rconErr != nil {
+			return fmt.Errorf("rest: %s, rcon: %s", err, rconErr)
 		}
-	} else if strings.HasPrefix(file, "k8s://") {
-		// k8s://namespace/pod/container:remotePath
-		namespace, podName, container, remotePath, err := source.ParseK8sAddress(file)
-		if err != nil {
-			return "", errors.New("error parsing k8s address: " + err.Error())
+	}
+
+	quiet := time.Duration(server.Save.BackupSettleSeconds) * time.Second
+	if quiet <= 0 {
+		quiet = 5 * time.Second
+	}
+	timeout := time.Duration(server.Save.BackupSettleTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+
+	if !local {
+		return waitForStatSettle(driver, before, requestTime, quiet, timeout)
+	}
+	savDir, err := driver.(*source.LocalDriver).SavDir()
+	if err != nil {
+		return err
+	}
+	return system.WaitForSavSettle(savDir, requestTime, quiet, timeout)
+}
+
+// waitForStatSettle polls the Stat of a remote save until it was written after since,
+// or changed from before, and then stayed the same for quiet. Sources that can't stat
+// the save get quiet to finish writing instead.
+func waitForStatSettle(driver source.Driver, before source.Stat, since time.Time, quiet, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var last source.Stat
+	stableSince := time.Now()
+	for {
+		stat, err := driver.Stat()
+		if errors.Is(err, source.ErrNotSupported) {
+			time.Sleep(quiet)
+			return nil
 		}
-		levelFilePath, err = source.CopyFromPod(namespace, podName, container, remotePath, way)
 		if err != nil {
-			return "", errors.New("error copying file from pod: " + err.Error())
+			return err
 		}
-	} else if strings.HasPrefix(file, "docker://") {
-		// docker://containerID(Name):remotePath
-		containerId, remotePath, err := source.ParseDockerAddress(file)
-		if err != nil {
-			return "", errors.New("error parsing docker address: " + err.Error())
+		if stat.Checksum != last.Checksum || !stat.ModTime.Equal(last.ModTime) {
+			last = stat
+			stableSince = time.Now()
 		}
-		levelFilePath, err = source.CopyFromContainer(containerId, remotePath, way)
-		if err != nil {
-			return "", errors.New("error copying file from container: " + err.Error())
+		written := !last.ModTime.Before(since) || (before.Checksum != "" && last.Checksum != before.Checksum)
+		if written && time.Since(stableSince) >= quiet {
+			return nil
 		}
-	} else {
-		// local file
-		levelFilePath, err = source.CopyFromLocal(file, way)
-		if err != nil {
-			return "", errors.New("error copying file to temporary directory: " + err.Error())
+		if time.Now().After(deadline) {
+			if !written {
+				return errors.New("save files were not written after the save request")
+			}
+			return errors.New("save files did not settle in time")
 		}
+		time.Sleep(time.Second)
 	}
-	return levelFilePath, nil
 }
 
 func BackupWithConfig(server *config.Server) (string, error) {
+	path, _, err := createBackupArchive(server)
+	return path, err
+}
+
+// createBackupArchive archives the server save and returns the archive name and
+// the checksums of the saved files
+func createBackupArchive(server *config.Server) (string, []database.BackupFile, error) {
 	sourcePath := server.Save.Path
 	if sourcePath == "" {
-		return "", errors.New("save path not configured for server")
+		return "", nil, errors.New("save path not configured for server")
 	}
 
-	levelFilePath, err := getFromSource(sourcePath, "backup")
+	driver, err := openSaveSource(server, sourcePath)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	levelFilePath, err := driver.Fetch("backup")
+	if err != nil {
+		return "", nil, err
 	}
 	defer os.RemoveAll(filepath.Dir(levelFilePath))
 
+	files, err := hashBackupFiles(filepath.Dir(levelFilePath))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to checksum save files: %s", err)
+	}
+
 	backupDir, err := GetBackupDirByServer(server.Id)
 	if err != nil {
-		return "", fmt.Errorf("failed to get backup directory: %s", err)
+		return "", nil, fmt.Errorf("failed to get backup directory: %s", err)
 	}
 
 	currentTime := time.Now().Format("2006-01-02-15-04-05")
-	backupZipFile := filepath.Join(backupDir, fmt.Sprintf("%s_%s.zip", server.Id, currentTime))
+	// the suffix keeps backups made within the same second from sharing one archive
+	backupZipFile := filepath.Join(backupDir, fmt.Sprintf("%s_%s_%s.zip", server.Id, currentTime, uuid.New().String()[:8]))
+	if getBackupFormat(server) == database.BackupFormatChunks {
+		store, err := getChunkStore()
+		if err != nil {
+			return "", nil, err
+		}
+		_, err = store.PutDir(backupKey(server.Id, filepath.Base(backupZipFile)), filepath.Dir(levelFilePath))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to store backup chunks: %s", err)
+		}
+		return filepath.Base(backupZipFile), files, nil
+	}
 	err = system.ZipDir(filepath.Dir(levelFilePath), backupZipFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to create backup zip: %s", err)
+		return "", nil, fmt.Errorf("failed to create backup zip: %s", err)
 	}
-	return filepath.Base(backupZipFile), nil
+
+	key, err := getBackupKey()
+	if err != nil {
+		os.Remove(backupZipFile)
+		return "", nil, err
+	}
+	if key != nil {
+		encryptedFile := backupZipFile + ".enc"
+		err = crypt.EncryptFile(backupZipFile, encryptedFile, key)
+		os.Remove(backupZipFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to encrypt backup: %s", err)
+		}
+		return filepath.Base(encryptedFile), files, nil
+	}
+	return filepath.Base(backupZipFile), files, nil
+}
+
+func getBackupFormat(server *config.Server) string {
+	if server.Save.BackupFormat == database.BackupFormatChunks {
+		return database.BackupFormatChunks
+	}
+	return database.BackupFormatZip
+}
+
+type BackupOptions struct {
+	Trigger string `json:"-"`
+	Label   string `json:"label"`
+	Note    string `json:"note"`
+	Pinned  bool   `json:"pinned"`
+}
+
+// NewBackupWithConfig creates a backup archive of the server save and records it
+func NewBackupWithConfig(db *bbolt.DB, server *config.Server, opts BackupOptions) (*database.Backup, error) {
+	preSaved := false
+	if server.Save.BackupPreSave {
+		if err := PreSaveWithConfig(server); err != nil {
+			logger.Warnf("Pre-save failed for server %s, backing up anyway: %v\n", server.Id, err)
+		} else {
+			preSaved = true
+		}
+	}
+
+	path, files, err := createBackupArchive(server)
+	if err != nil {
+		return nil, err
+	}
+
+	trigger := opts.Trigger
+	if trigger == "" {
+		trigger = database.BackupTriggerScheduled
+	}
+	backup := database.Backup{
+		ServerId: server.Id,
+		BackupId: uuid.New().String(),
+		Path:     path,
+		SaveTime: time.Now(),
+		PreSaved: preSaved,
+		Label:    opts.Label,
+		Note:     opts.Note,
+		Pinned:   opts.Pinned,
+		Trigger:  trigger,
+		Format:   getBackupFormat(server),
+		Files:    files,
+	}
+	key, err := getBackupKey()
+	if err != nil {
+		return nil, err
+	}
+	backup.Encrypted = key != nil
+	backup.Size, backup.Sha256, err = statLocalBackup(&backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum backup: %s", err)
+	}
+	backup.Targets = uploadBackupWithConfig(server, &backup, key)
+	if err = service.AddBackupByServer(db, server.Id, backup); err != nil {
+		return nil, fmt.Errorf("failed to save backup record: %s", err)
+	}
+	return &backup, nil
+}
+
+// GetBackupFilePathByServer returns the location of a backup archive of the server
+func GetBackupFilePathByServer(serverId, path string) (string, error) {
+	backupDir, err := GetBackupDirByServer(serverId)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(backupDir, path), nil
 }
 
 func GetBackupDirByServer(serverId string) (string, error) {
@@ -258,32 +496,63 @@ func GetBackupDirByServer(serverId string) (string, error) {
 	return backDir, nil
 }
 
-func CleanOldBackupsByServer(db *bbolt.DB, serverId string, keepDays int) error {
-	backups, err := service.ListBackupsByServer(db, serverId)
+// CleanOldBackupsByServer removes local archives dropped by the server retention policy and
+// remote copies older than their target keep_days, falling back to the same policy
+func CleanOldBackupsByServer(db *bbolt.DB, server *config.Server) error {
+	backups, err := service.ListBackupsByServer(db, server.Id)
 	if err != nil {
 		return err
 	}
 
-	cutoff := time.Now().AddDate(0, 0, -keepDays)
-	for _, backup := range backups {
-		if backup.SaveTime.Before(cutoff) {
+	now := time.Now()
+	decisions := PlanBackupRetention(backups, server.Save.BackupRetention, getKeepDays(server), now)
+	removedChunked := false
+	for _, decision := range decisions {
+		backup := decision.Backup
+		if backup.Pinned {
+			continue
+		}
+		hasLocal := hasLocalBackup(&backup)
+		if hasLocal && !decision.Keep {
 			// Delete the backup file
-			backupDir, err := GetBackupDirByServer(serverId)
-			if err != nil {
-				logger.Warnf("Failed to get backup directory for server %s: %v", serverId, err)
-				continue
+			if err := removeLocalBackup(&backup); err != nil {
+				logger.Warnf("Failed to remove backup file %s: %v\n", backup.Path, err)
+			} else {
+				hasLocal = false
+				removedChunked = removedChunked || isChunkedBackup(&backup)
 			}
+		}
 
-			backupPath := filepath.Join(backupDir, backup.Path)
-			if err := os.Remove(backupPath); err != nil {
-				logger.Warnf("Failed to remove backup file %s: %v", backupPath, err)
+		var targets, removed []string
+		for _, name := range backup.Targets {
+			expired := !decision.Keep
+			if cfg, ok := config.GetBackupTarget(name); ok && cfg.KeepDays > 0 {
+				expired = backup.SaveTime.Before(now.AddDate(0, 0, -cfg.KeepDays))
+			}
+			if expired {
+				if err := deleteFromTarget(name, backupKey(server.Id, backup.Path)); err != nil {
+					logger.Warnf("Failed to remove backup %s from target %s: %v\n", backup.Path, name, err)
+				} else {
+					removed = append(removed, name)
+					continue
+				}
 			}
+			targets = append(targets, name)
+		}
 
+		if !hasLocal && len(targets) == 0 && !decision.Keep {
 			// Delete the backup record
-			if err := service.DeleteBackupByServer(db, serverId, backup.BackupId); err != nil {
-				logger.Warnf("Failed to delete backup record %s: %v", backup.BackupId, err)
+			if err := service.DeleteBackupByServer(db, server.Id, backup.BackupId); err != nil {
+				logger.Warnf("Failed to delete backup record %s: %v\n", backup.BackupId, err)
+			}
+		} else if len(removed) > 0 {
+			if err := service.RemoveBackupTargetsByServer(db, server.Id, backup.BackupId, removed); err != nil && err != service.ErrNoRecord {
+				logger.Warnf("Failed to update backup record %s: %v\n", backup.BackupId, err)
 			}
 		}
 	}
+	if removedChunked {
+		gcChunkStore()
+	}
 	return nil
 }
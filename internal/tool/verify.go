@@ -0,0 +1,131 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaigie/palworld-server-tool/internal/config"
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"github.com/zaigie/palworld-server-tool/internal/logger"
+	"github.com/zaigie/palworld-server-tool/internal/system"
+	"github.com/zaigie/palworld-server-tool/service"
+	"go.etcd.io/bbolt"
+)
+
+// hashBackupFiles returns the size and sha256 of every regular file below dir
+func hashBackupFiles(dir string) ([]database.BackupFile, error) {
+	var files []database.BackupFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		size, checksum, err := system.Sha256File(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, database.BackupFile{Name: filepath.ToSlash(rel), Size: size, Sha256: checksum})
+		return nil
+	})
+	return files, err
+}
+
+// VerifyBackupByServer re-reads a backup, checks its archive and file checksums and the
+// save headers, and records the result on the backup. Failures are logged as alerts.
+func VerifyBackupByServer(db *bbolt.DB, backup *database.Backup) error {
+	verifyErr := verifyBackup(backup)
+	backup.VerifiedAt = time.Now()
+	if verifyErr != nil {
+		backup.VerifyStatus = database.BackupVerifyFailed
+		backup.VerifyError = verifyErr.Error()
+		logger.Errorf("ALERT: backup %s of server %s failed verification: %v\n", backup.Path, backup.ServerId, verifyErr)
+	} else {
+		backup.VerifyStatus = database.BackupVerifyOk
+		backup.VerifyError = ""
+	}
+
+	err := service.UpdateBackupVerificationByServer(db, backup.ServerId, backup.BackupId, backup.VerifiedAt, backup.VerifyStatus, backup.VerifyError)
+	// retention may have removed the backup meanwhile
+	if err != nil && !errors.Is(err, service.ErrNoRecord) {
+		logger.Errorf("Failed to save verification of backup %s: %v\n", backup.BackupId, err)
+	}
+	return verifyErr
+}
+
+func verifyBackup(backup *database.Backup) error {
+	if backup.Sha256 != "" && hasLocalBackup(backup) {
+		_, checksum, err := statLocalBackup(backup)
+		if err != nil {
+			return err
+		}
+		if checksum != backup.Sha256 {
+			return errors.New("archive checksum mismatch")
+		}
+	}
+
+	tempDir := filepath.Join(os.TempDir(), "pst-verify-"+uuid.New().String())
+	if err := system.CleanAndCreateDir(tempDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := ExtractBackupByServer(backup, tempDir); err != nil {
+		return fmt.Errorf("failed to read archive: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "Level.sav")); err != nil {
+		return errors.New("backup does not contain Level.sav")
+	}
+	names, err := system.ListSavFiles(tempDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := system.CheckSavHeader(filepath.Join(tempDir, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	for _, file := range backup.Files {
+		size, checksum, err := system.Sha256File(filepath.Join(tempDir, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", file.Name, err)
+		}
+		if size != file.Size || checksum != file.Sha256 {
+			return fmt.Errorf("%s: checksum mismatch", file.Name)
+		}
+	}
+	return nil
+}
+
+// VerifyBackupsByServer verifies every backup of the server kept on this host.
+// Backups only on backup targets are skipped to avoid downloading them each run.
+func VerifyBackupsByServer(db *bbolt.DB, server *config.Server) error {
+	backups, err := service.ListBackupsByServer(db, server.Id)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, backup := range backups {
+		if !hasLocalBackup(&backup) {
+			continue
+		}
+		if err := VerifyBackupByServer(db, &backup); err != nil {
+			failed = append(failed, backup.Path)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d backups failed verification: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -19,12 +19,17 @@ import (
 	"github.com/zaigie/palworld-server-tool/internal/logger"
 	"github.com/zaigie/palworld-server-tool/internal/system"
 	"github.com/zaigie/palworld-server-tool/internal/task"
+	"github.com/zaigie/palworld-server-tool/internal/tool"
 )
 
 var (
 	version string = "Develop"
 	cfgFile string
 	conf    config.Config
+
+	rotateBackupKey     bool
+	newBackupPassphrase string
+	newBackupKeyFile    string
 )
 
 //go:embed assets/*
@@ -41,6 +46,9 @@ var mapTiles embed.FS
 
 func setupFlags() {
 	flag.StringVar(&cfgFile, "config", "", "config file")
+	flag.BoolVar(&rotateBackupKey, "rotate-backup-key", false, "re-encrypt all backups with the new backup key and exit")
+	flag.StringVar(&newBackupPassphrase, "new-backup-passphrase", "", "new backup encryption passphrase for -rotate-backup-key")
+	flag.StringVar(&newBackupKeyFile, "new-backup-key-file", "", "new backup encryption key file for -rotate-backup-key")
 	flag.Parse()
 }
 
@@ -57,6 +65,20 @@ func main() {
 	setupFlags()
 	config.Init(cfgFile, &conf)
 
+	if rotateBackupKey {
+		key, err := tool.NewBackupKey(newBackupPassphrase, newBackupKeyFile)
+		if err == nil {
+			err = tool.RotateBackupKey(db, key)
+		}
+		if err != nil {
+			logger.Errorf("Backup key rotation failed: %v\n", err)
+			db.Close()
+			os.Exit(1)
+		}
+		logger.Info("Backup key rotated, set the new key in backup.encryption of the config before restarting\n")
+		return
+	}
+
 	docs.SwaggerInfo.Title = "Palworld Manage API"
 	docs.SwaggerInfo.Version = version
 	docs.SwaggerInfo.Host = fmt.Sprintf("127.0.0.1:%d", viper.GetInt("web.port"))
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/zaigie/palworld-server-tool/internal/database"
@@ -403,6 +404,77 @@ func AddBackupByServer(db *bbolt.DB, serverId string, backup database.Backup) er
 	})
 }
 
+// UpdateBackupVerificationByServer records the verification result on a backup, leaving
+// edits made to the record while it was being verified in place
+func UpdateBackupVerificationByServer(db *bbolt.DB, serverId, backupId string, verifiedAt time.Time, status, verifyError string) error {
+	_, err := updateBackupByServer(db, serverId, backupId, func(backup *database.Backup) {
+		backup.VerifiedAt = verifiedAt
+		backup.VerifyStatus = status
+		backup.VerifyError = verifyError
+	})
+	return err
+}
+
+// UpdateBackupMetaByServer sets the label, note and pin of a backup, nil fields are left as they are
+func UpdateBackupMetaByServer(db *bbolt.DB, serverId, backupId string, label, note *string, pinned *bool) (*database.Backup, error) {
+	return updateBackupByServer(db, serverId, backupId, func(backup *database.Backup) {
+		if label != nil {
+			backup.Label = *label
+		}
+		if note != nil {
+			backup.Note = *note
+		}
+		if pinned != nil {
+			backup.Pinned = *pinned
+		}
+	})
+}
+
+// RemoveBackupTargetsByServer drops targets a backup was deleted from
+func RemoveBackupTargetsByServer(db *bbolt.DB, serverId, backupId string, removed []string) error {
+	_, err := updateBackupByServer(db, serverId, backupId, func(backup *database.Backup) {
+		targets := backup.Targets[:0]
+		for _, name := range backup.Targets {
+			if !slices.Contains(removed, name) {
+				targets = append(targets, name)
+			}
+		}
+		backup.Targets = targets
+	})
+	return err
+}
+
+// updateBackupByServer reloads a backup and applies update to it in one transaction,
+// so fields written concurrently by others are kept
+func updateBackupByServer(db *bbolt.DB, serverId, backupId string, update func(backup *database.Backup)) (*database.Backup, error) {
+	var backup database.Backup
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("backups"))
+		if b == nil {
+			return ErrNoRecord
+		}
+
+		key := []byte(fmt.Sprintf("%s_%s", serverId, backupId))
+		v := b.Get(key)
+		if v == nil {
+			return ErrNoRecord
+		}
+		if err := json.Unmarshal(v, &backup); err != nil {
+			return err
+		}
+		update(&backup)
+		data, err := json.Marshal(backup)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
 // PutWhitelistByServer stores whitelist for a specific server
 func PutWhitelistByServer(db *bbolt.DB, serverId string, players []database.PlayerW) error {
 	return db.Update(func(tx *bbolt.Tx) error {
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/zaigie/palworld-server-tool/internal/database"
+	"go.etcd.io/bbolt"
+)
+
+// GetTaskState returns the persisted state of a scheduled task, a fresh state when
+// the task never ran
+func GetTaskState(db *bbolt.DB, name string) (database.TaskState, error) {
+	state := database.TaskState{Name: name}
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("tasks"))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &state)
+	})
+	return state, err
+}
+
+// UpdateTaskState applies fn to the state of a scheduled task and stores it
+func UpdateTaskState(db *bbolt.DB, name string, fn func(state *database.TaskState)) (database.TaskState, error) {
+	state := database.TaskState{Name: name}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("tasks"))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			if err = json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+		}
+		fn(&state)
+		v, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+	return state, err
+}